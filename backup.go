@@ -0,0 +1,216 @@
+package tlytics
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backuper is implemented by stores that can write a consistent snapshot of
+// themselves to a file while the server is running
+type Backuper interface {
+	Backup(destPath string) error
+}
+
+// Backup writes a consistent copy of the database to destPath using VACUUM INTO.
+// It reads from a snapshot, so inserts continue while the backup runs.
+func (db *DB) Backup(destPath string) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup file already exists: %s", destPath)
+	}
+
+	if _, err := db.reader.Exec("VACUUM INTO ?", destPath); err != nil {
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+
+	return nil
+}
+
+const (
+	backupPrefix     = "tlytics-"
+	backupSuffix     = ".sqlite"
+	backupTimeFormat = "20060102T150405.000Z"
+)
+
+// backupManager writes timestamped backups to a directory and removes
+// the oldest ones beyond keep
+type backupManager struct {
+	store Backuper
+	dir   string
+	keep  int
+	mutex sync.Mutex
+}
+
+func newBackupManager(store Backuper, dir string, keep int) *backupManager {
+	return &backupManager{
+		store: store,
+		dir:   dir,
+		keep:  keep,
+	}
+}
+
+// run creates a new backup and returns its path
+func (m *backupManager) run() (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	path := filepath.Join(m.dir, name)
+
+	if err := m.store.Backup(path); err != nil {
+		return "", err
+	}
+
+	if err := m.rotate(); err != nil {
+		return path, err
+	}
+
+	return path, nil
+}
+
+// rotate removes the oldest backups so that at most keep remain
+func (m *backupManager) rotate() error {
+	if m.keep <= 0 {
+		return nil
+	}
+
+	backups, err := m.list()
+	if err != nil {
+		return err
+	}
+
+	for len(backups) > m.keep {
+		if err := os.Remove(filepath.Join(m.dir, backups[0])); err != nil {
+			return fmt.Errorf("failed to remove old backup: %w", err)
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
+
+// list returns the backup file names in the directory, oldest first
+func (m *backupManager) list() ([]string, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, name)
+		}
+	}
+
+	// The timestamp format sorts chronologically
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+// backupWorker runs scheduled backups until stopCh is closed
+func (m *backupManager) backupWorker(period time.Duration, stopCh chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := m.run(); err != nil {
+				// In a production system, you might want to log this error
+				_ = err
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Restore replaces the database at dbPath with a backup.
+// The server using dbPath must not be running.
+func Restore(backupPath, dbPath string) error {
+	if err := checkBackup(backupPath); err != nil {
+		return err
+	}
+
+	src, err := os.Open(backupPath)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer src.Close()
+
+	// Copy next to the target and rename, so a failed restore leaves the database intact
+	tmpPath := dbPath + ".restore"
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create database file: %w", err)
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to copy backup: %w", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write database file: %w", err)
+	}
+
+	// Stale WAL files would be replayed onto the restored database
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmpPath)
+			return fmt.Errorf("failed to remove %s file: %w", suffix, err)
+		}
+	}
+
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace database: %w", err)
+	}
+
+	return nil
+}
+
+// checkBackup verifies that the file is an intact tlytics database
+func checkBackup(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("backup not found: %w", err)
+	}
+
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer conn.Close()
+
+	var result string
+	if err := conn.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return fmt.Errorf("failed to check backup: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup is corrupt: %s", result)
+	}
+
+	var count int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM tlytics").Scan(&count); err != nil {
+		return fmt.Errorf("backup has no tlytics table: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package tlytics
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRotationAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "analytics.sqlite")
+	backupDir := filepath.Join(dir, "backups")
+
+	db, err := Init(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.InsertEvents([]Event{{Key: "before_backup", Timestamp: time.Now()}}); err != nil {
+		t.Fatalf("Failed to insert events: %v", err)
+	}
+
+	backups := newBackupManager(db, backupDir, 2)
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		path, err := backups.run()
+		if err != nil {
+			t.Fatalf("Backup %d failed: %v", i, err)
+		}
+		paths = append(paths, path)
+
+		// Backup names have millisecond resolution
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	// Only the 2 newest backups are kept
+	names, err := backups.list()
+	if err != nil {
+		t.Fatalf("Failed to list backups: %v", err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("Expected 2 backups after rotation, got %v", names)
+	}
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Errorf("Expected oldest backup %s to be removed", paths[0])
+	}
+
+	// Events written after the backup are gone after restore
+	if err := db.InsertEvents([]Event{{Key: "after_backup", Timestamp: time.Now()}}); err != nil {
+		t.Fatalf("Failed to insert events: %v", err)
+	}
+	db.Close()
+
+	if err := Restore(paths[2], dbPath); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	restored, err := Init(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	defer restored.Close()
+
+	events, total, err := restored.GetEvents(10, 0)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	if total != 1 || events[0].Key != "before_backup" {
+		t.Errorf("Expected only the event from before the backup, got %v", events)
+	}
+
+	// Anything that isn't a tlytics database is rejected
+	if err := Restore(filepath.Join(dir, "missing.sqlite"), dbPath); err == nil {
+		t.Error("Expected restore from a missing file to fail")
+	}
+}
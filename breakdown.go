@@ -0,0 +1,203 @@
+package tlytics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Breakdown orders
+const (
+	OrderByCount = "count"
+	OrderBySum   = "sum"
+	OrderByAvg   = "avg"
+)
+
+// DefaultBreakdownLimit is how many groups the breakdown endpoint returns if not set
+const DefaultBreakdownLimit = 10
+
+// Breakdown groups events by the values of one or two data fields. Values
+// are compared as text, like Query.Field, and events missing a field are
+// skipped.
+type Breakdown struct {
+	Fields  []string // Data fields to group by, one or two
+	Sum     string   // Numeric data field to sum and average per group, optional
+	OrderBy string   // OrderByCount (default), OrderBySum or OrderByAvg, largest first
+}
+
+// BreakdownGroup holds the events with the same values of the breakdown fields
+type BreakdownGroup struct {
+	Values []string `json:"values"`
+	Count  int      `json:"count"`
+	Sum    *float64 `json:"sum,omitempty"` // Set if Breakdown.Sum is, non-numeric values are skipped
+	Avg    *float64 `json:"avg,omitempty"` // Set if any value of Breakdown.Sum is numeric
+
+	numeric int // Events with a numeric Sum field, to average merged groups
+}
+
+func (b Breakdown) validate() error {
+	if len(b.Fields) == 0 || len(b.Fields) > 2 {
+		return fmt.Errorf("breakdown needs one or two fields, got %d", len(b.Fields))
+	}
+	for _, field := range b.Fields {
+		if field == "" {
+			return fmt.Errorf("breakdown field must not be empty")
+		}
+	}
+
+	switch b.OrderBy {
+	case "", OrderByCount:
+	case OrderBySum, OrderByAvg:
+		if b.Sum == "" {
+			return fmt.Errorf("ordering by %s needs a sum field", b.OrderBy)
+		}
+	default:
+		return fmt.Errorf("invalid breakdown order: %s", b.OrderBy)
+	}
+
+	return nil
+}
+
+// add counts an event with the sum field value v in the group
+func (g *BreakdownGroup) add(b Breakdown, v interface{}) {
+	g.Count++
+	if b.Sum == "" {
+		return
+	}
+	if g.Sum == nil {
+		g.Sum = new(float64)
+	}
+	if f, ok := numericValue(v); ok {
+		*g.Sum += f
+		g.numeric++
+	}
+}
+
+// merge adds the events of other to the group
+func (g *BreakdownGroup) merge(other BreakdownGroup) {
+	g.Count += other.Count
+	if other.Sum != nil {
+		if g.Sum == nil {
+			g.Sum = new(float64)
+		}
+		*g.Sum += *other.Sum
+	}
+	g.numeric += other.numeric
+}
+
+// setAvg sets Avg from Sum and the number of numeric values
+func (g *BreakdownGroup) setAvg() {
+	g.Avg = nil
+	if g.Sum != nil && g.numeric > 0 {
+		avg := *g.Sum / float64(g.numeric)
+		g.Avg = &avg
+	}
+}
+
+// numericValue returns v as a float64 if it is a number
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// breakdownEvents groups the events in Go, for stores without SQL
+func breakdownEvents(events []Event, b Breakdown) map[string]*BreakdownGroup {
+	groups := make(map[string]*BreakdownGroup)
+
+	for _, e := range events {
+		values := make([]string, 0, len(b.Fields))
+		for _, field := range b.Fields {
+			v, ok := e.Data[field]
+			if !ok || v == nil {
+				break
+			}
+			values = append(values, fmt.Sprint(v))
+		}
+		if len(values) != len(b.Fields) {
+			continue
+		}
+
+		id := strings.Join(values, "\x00")
+		group, ok := groups[id]
+		if !ok {
+			group = &BreakdownGroup{Values: values}
+			groups[id] = group
+		}
+		group.add(b, e.Data[b.Sum])
+	}
+
+	return groups
+}
+
+// sortBreakdown sets the averages, orders the groups largest first, ties by
+// their values, and keeps at most limit if positive
+func sortBreakdown(groups map[string]*BreakdownGroup, b Breakdown, limit int) []BreakdownGroup {
+	result := make([]BreakdownGroup, 0, len(groups))
+	for _, group := range groups {
+		group.setAvg()
+		result = append(result, *group)
+	}
+
+	metric := func(g BreakdownGroup) (float64, bool) {
+		switch b.OrderBy {
+		case OrderBySum:
+			return *g.Sum, true
+		case OrderByAvg:
+			if g.Avg == nil {
+				return 0, false
+			}
+			return *g.Avg, true
+		default:
+			return float64(g.Count), true
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, aok := metric(result[i])
+		c, cok := metric(result[j])
+		if aok != cok {
+			// Groups without an average go last
+			return aok
+		}
+		if a != c {
+			return a > c
+		}
+		for k := range result[i].Values {
+			if result[i].Values[k] != result[j].Values[k] {
+				return result[i].Values[k] < result[j].Values[k]
+			}
+		}
+		return false
+	})
+
+	if limit > 0 && limit < len(result) {
+		result = result[:limit]
+	}
+
+	return result
+}
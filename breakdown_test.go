@@ -0,0 +1,177 @@
+package tlytics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func breakdownTestEvents() []Event {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+	request := func(days int, path string, status int, duration interface{}) Event {
+		data := map[string]interface{}{"path": path, "status_code": status}
+		if duration != nil {
+			data["duration_ms"] = duration
+		}
+		return Event{Key: "request", Timestamp: base.AddDate(0, 0, days), Data: data}
+	}
+
+	// Spread over two months, so the partitioned store merges files
+	return []Event{
+		request(0, "/", 200, 10),
+		request(0, "/", 200, 30),
+		request(10, "/", 200, 20),
+		request(0, "/api/users", 200, 100),
+		request(10, "/api/users", 500, 900),
+		request(10, "/api/users", 500, "slow"),
+		request(0, "/login", 302, nil),
+		{Key: "request", Timestamp: base, Data: map[string]interface{}{"status_code": 404}},
+		{Key: "page_view", Timestamp: base, Data: map[string]interface{}{"path": "/"}},
+	}
+}
+
+func TestStoreBreakdown(t *testing.T) {
+	float := func(f float64) *float64 { return &f }
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.InsertEvents(breakdownTestEvents()); err != nil {
+				t.Fatalf("Failed to insert events: %v", err)
+			}
+
+			groups, err := store.Breakdown(Query{Key: "request"}, Breakdown{Fields: []string{"path"}})
+			if err != nil {
+				t.Fatalf("Failed to break down events: %v", err)
+			}
+			expected := []BreakdownGroup{
+				{Values: []string{"/"}, Count: 3},
+				{Values: []string{"/api/users"}, Count: 3},
+				{Values: []string{"/login"}, Count: 1},
+			}
+			if !reflect.DeepEqual(groups, expected) {
+				t.Errorf("Expected %+v, got %+v", expected, groups)
+			}
+
+			groups, err = store.Breakdown(
+				Query{Key: "request", Limit: 2},
+				Breakdown{Fields: []string{"path", "status_code"}, Sum: "duration_ms", OrderBy: OrderByAvg},
+			)
+			if err != nil {
+				t.Fatalf("Failed to break down events: %v", err)
+			}
+			expected = []BreakdownGroup{
+				{Values: []string{"/api/users", "500"}, Count: 2, Sum: float(900), Avg: float(900), numeric: 1},
+				{Values: []string{"/api/users", "200"}, Count: 1, Sum: float(100), Avg: float(100), numeric: 1},
+			}
+			if !reflect.DeepEqual(groups, expected) {
+				t.Errorf("Expected %+v, got %+v", expected, groups)
+			}
+
+			groups, err = store.Breakdown(
+				Query{Key: "request", Field: "path", Value: "/login"},
+				Breakdown{Fields: []string{"status_code"}, Sum: "duration_ms"},
+			)
+			if err != nil {
+				t.Fatalf("Failed to break down events: %v", err)
+			}
+			expected = []BreakdownGroup{{Values: []string{"302"}, Count: 1, Sum: float(0)}}
+			if !reflect.DeepEqual(groups, expected) {
+				t.Errorf("Expected %+v, got %+v", expected, groups)
+			}
+
+			if _, err := store.Breakdown(Query{}, Breakdown{Fields: []string{"path"}, OrderBy: OrderBySum}); err == nil {
+				t.Error("Expected an error ordering by sum without a sum field")
+			}
+		})
+	}
+}
+
+func TestStoreBreakdownBooleans(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Key: "view", Timestamp: base, Data: map[string]interface{}{"is_bot": true, "bot": true}},
+		{Key: "view", Timestamp: base, Data: map[string]interface{}{"is_bot": true, "bot": true}},
+		{Key: "view", Timestamp: base, Data: map[string]interface{}{"is_bot": false, "bot": false}},
+	}
+	expected := []BreakdownGroup{
+		{Values: []string{"true", "true"}, Count: 2},
+		{Values: []string{"false", "false"}, Count: 1},
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// bot is read from a hot field column where supported
+			if hotStore, ok := store.(HotFieldStore); ok {
+				if err := hotStore.SetHotFields(map[string][]string{"view": {"bot"}}); err != nil {
+					t.Fatalf("Failed to set hot fields: %v", err)
+				}
+			}
+			if err := store.InsertEvents(events); err != nil {
+				t.Fatalf("Failed to insert events: %v", err)
+			}
+
+			groups, err := store.Breakdown(Query{Key: "view"}, Breakdown{Fields: []string{"is_bot", "bot"}})
+			if err != nil {
+				t.Fatalf("Failed to break down events: %v", err)
+			}
+			if !reflect.DeepEqual(groups, expected) {
+				t.Errorf("Expected %+v, got %+v", expected, groups)
+			}
+
+			if count, _ := store.CountEvents(Query{Key: "view", Field: "bot", Value: "true"}); count != 2 {
+				t.Errorf("Expected 2 events with bot true, got %d", count)
+			}
+		})
+	}
+}
+
+func TestBreakdownEndpoint(t *testing.T) {
+	store := NewMemoryStore()
+	store.InsertEvents(breakdownTestEvents())
+
+	gin.SetMode(gin.TestMode)
+	server := newHTTPServer(nil, store, 0)
+
+	req := httptest.NewRequest("GET", "/analysis/breakdown?key=request&by=status_code&sum=duration_ms&order=sum&limit=2", nil)
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response BreakdownResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if len(response.Groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %+v", response.Groups)
+	}
+	if g := response.Groups[0]; g.Values[0] != "500" || g.Count != 2 || *g.Sum != 900 {
+		t.Errorf("Expected status 500 first, got %+v", g)
+	}
+	if g := response.Groups[1]; g.Values[0] != "200" || g.Count != 4 || *g.Sum != 160 || *g.Avg != 40 {
+		t.Errorf("Expected status 200 second, got %+v", g)
+	}
+
+	for _, query := range []string{
+		"by=path",
+		"key=request",
+		"key=request&by=a,b,c",
+		"key=request&by=path&order=avg",
+		"key=request&by=path&limit=0",
+	} {
+		req := httptest.NewRequest("GET", "/analysis/breakdown?"+query, nil)
+		w := httptest.NewRecorder()
+		server.router().ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", query, w.Code)
+		}
+	}
+}
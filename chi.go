@@ -0,0 +1,20 @@
+package tlytics
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ChiMiddleware is HTTPMiddleware recording chi route patterns like /users/{id}.
+// Use it with chi.Router.Use.
+func ChiMiddleware(analytics Emitter, opts MiddlewareOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return httpMiddleware(analytics, opts, next, func(r *http.Request) string {
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				return rctx.RoutePattern()
+			}
+			return ""
+		})
+	}
+}
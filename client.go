@@ -2,6 +2,7 @@ package tlytics
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -12,6 +13,8 @@ import (
 type Client struct {
 	serverURL   string
 	httpClient  *http.Client
+	processors  []Processor
+	rawPII      []string
 	queue       []Event
 	flushPeriod time.Duration
 	mutex       sync.RWMutex
@@ -19,7 +22,7 @@ type Client struct {
 	wg          sync.WaitGroup
 }
 
-func newHTTPClient(serverURL string, flushPeriod time.Duration) *Client {
+func newHTTPClient(serverURL string, flushPeriod time.Duration, processors []Processor, rawPII []string) *Client {
 	if flushPeriod == 0 {
 		flushPeriod = 5 * time.Second
 	}
@@ -27,6 +30,8 @@ func newHTTPClient(serverURL string, flushPeriod time.Duration) *Client {
 	client := &Client{
 		serverURL:   serverURL,
 		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		processors:  processors,
+		rawPII:      rawPII,
 		queue:       make([]Event, 0),
 		flushPeriod: flushPeriod,
 		stopCh:      make(chan struct{}),
@@ -43,6 +48,10 @@ func (c *Client) Emit(e Event) error {
 		e.Timestamp = time.Now()
 	}
 
+	if ok, err := processEvent(c.processors, c.rawPII, &e); !ok {
+		return err
+	}
+
 	c.mutex.Lock()
 	c.queue = append(c.queue, e)
 	c.mutex.Unlock()
@@ -50,11 +59,20 @@ func (c *Client) Emit(e Event) error {
 	return nil
 }
 
+// EmitContext queues the event with the properties attached to the context
+func (c *Client) EmitContext(ctx context.Context, e Event) error {
+	return c.Emit(enrich(ctx, e))
+}
+
 func (c *Client) EmitAndSend(e Event) error {
 	if e.Timestamp.IsZero() {
 		e.Timestamp = time.Now()
 	}
 
+	if ok, err := processEvent(c.processors, c.rawPII, &e); !ok {
+		return err
+	}
+
 	return c.sendEvents([]Event{e})
 }
 
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/t0mk/tlytics"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(os.Args[2:])
+		return
+	}
+
+	serve(os.Args[1:])
+}
+
+// defaultDBPath is the database path unless --db is given
+func defaultDBPath() string {
+	if path := os.Getenv("TLYTICS_DB"); path != "" {
+		return path
+	}
+	return "./analytics.db"
+}
+
+func serve(args []string) {
+	fs := flag.NewFlagSet("tlytics", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath(), "Path to SQLite database file")
+	port := fs.Int("port", 8081, "Port for analytics collection server")
+	flush := fs.Duration("flush", 5*time.Second, "Flush period for batching events")
+	backend := fs.String("backend", tlytics.BackendSQLite, "Storage backend: sqlite, memory, postgres or partitioned")
+	databaseURL := fs.String("database-url", os.Getenv("TLYTICS_DATABASE_URL"), "PostgreSQL connection string for the postgres backend")
+	partition := fs.String("partition", tlytics.PartitionDaily, "Partition files per day or month for the partitioned backend")
+	retention := fs.Duration("retention", 0, "Drop partitions older than this for the partitioned backend, 0 keeps everything")
+	backupDir := fs.String("backup-dir", "", "Directory for backups, enables POST /admin/backup")
+	backupInterval := fs.Duration("backup-interval", 0, "How often to back up to --backup-dir, 0 disables scheduled backups")
+	backupKeep := fs.Int("backup-keep", 7, "Number of backups to keep, 0 keeps all")
+	adminToken := fs.String("admin-token", os.Getenv("TLYTICS_ADMIN_TOKEN"), "Bearer token required by /admin endpoints, which are disabled without one")
+	erasureSecret := fs.String("erasure-secret", os.Getenv("TLYTICS_ERASURE_SECRET"), "Key of the identifier hashes in erasure records, required to erase subjects")
+	fs.Parse(args)
+
+	server, err := tlytics.NewServer(tlytics.ServerConfig{
+		DBPath:             *dbPath,
+		FlushPeriod:        *flush,
+		ServerPort:         *port,
+		Backend:            *backend,
+		DatabaseURL:        *databaseURL,
+		Partition:          *partition,
+		PartitionRetention: *retention,
+		BackupDir:          *backupDir,
+		BackupInterval:     *backupInterval,
+		BackupKeep:         *backupKeep,
+		AdminToken:         *adminToken,
+		ErasureSecret:      *erasureSecret,
+	})
+	if err != nil {
+		log.Fatal("Failed to start tlytics server:", err)
+	}
+	defer server.Close()
+
+	log.Printf("Starting tlytics server on port %d...", *port)
+	if err := server.StartServer(); err != nil {
+		log.Fatal("Server error:", err)
+	}
+}
+
+func restore(args []string) {
+	fs := flag.NewFlagSet("tlytics restore", flag.ExitOnError)
+	dbPath := fs.String("db", defaultDBPath(), "Path to SQLite database file to replace")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: tlytics restore [--db path] <backup file>")
+		fmt.Fprintln(fs.Output(), "Replaces the database with a backup. Stop the server first.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := tlytics.Restore(fs.Arg(0), *dbPath); err != nil {
+		log.Fatal("Restore failed:", err)
+	}
+
+	log.Printf("Restored %s from %s", *dbPath, fs.Arg(0))
+}
@@ -0,0 +1,104 @@
+package tlytics
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContextEmitter is an Emitter that adds the properties attached to a context to events
+type ContextEmitter interface {
+	Emitter
+	EmitContext(ctx context.Context, event Event) error
+}
+
+type propertiesKey struct{}
+
+// WithProperties returns a context carrying the properties in addition to the
+// ones already attached. Events emitted with EmitContext get them in their data.
+func WithProperties(ctx context.Context, props map[string]interface{}) context.Context {
+	existing := Properties(ctx)
+
+	merged := make(map[string]interface{}, len(existing)+len(props))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range props {
+		merged[k] = v
+	}
+
+	return context.WithValue(ctx, propertiesKey{}, merged)
+}
+
+// WithProperty returns a context carrying the property, see WithProperties
+func WithProperty(ctx context.Context, key string, value interface{}) context.Context {
+	return WithProperties(ctx, map[string]interface{}{key: value})
+}
+
+// Properties returns the properties attached to the context. The map must not be modified.
+func Properties(ctx context.Context) map[string]interface{} {
+	props, _ := ctx.Value(propertiesKey{}).(map[string]interface{})
+	return props
+}
+
+// enrich returns the event with the context's properties added to a copy of
+// its data. Fields already in the event take precedence.
+func enrich(ctx context.Context, event Event) Event {
+	props := Properties(ctx)
+	if len(props) == 0 {
+		return event
+	}
+
+	data := make(map[string]interface{}, len(props)+len(event.Data))
+	for k, v := range props {
+		data[k] = v
+	}
+	for k, v := range event.Data {
+		data[k] = v
+	}
+	event.Data = data
+
+	return event
+}
+
+// EmitContext emits the event with the context's properties using any Emitter
+func EmitContext(ctx context.Context, analytics Emitter, event Event) error {
+	if ce, ok := analytics.(ContextEmitter); ok {
+		return ce.EmitContext(ctx, event)
+	}
+	return analytics.Emit(enrich(ctx, event))
+}
+
+// GinContextProperties attaches the fields from the extractors to the request
+// context, so events emitted with EmitContext(c.Request.Context(), ...) in
+// later handlers get them. Unlike with TrackEvent the extractors run before the
+// handler.
+func GinContextProperties(extractors ...DataExtractor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		props := make(map[string]interface{})
+		for _, extract := range extractors {
+			for k, v := range extract(c) {
+				props[k] = v
+			}
+		}
+
+		if len(props) > 0 {
+			c.Request = c.Request.WithContext(WithProperties(c.Request.Context(), props))
+		}
+
+		c.Next()
+	}
+}
+
+// HTTPContextProperties is GinContextProperties for net/http handlers
+func HTTPContextProperties(extract func(r *http.Request) map[string]interface{}) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if props := extract(r); len(props) > 0 {
+				r = r.WithContext(WithProperties(r.Context(), props))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
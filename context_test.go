@@ -0,0 +1,76 @@
+package tlytics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoggerEmitContext(t *testing.T) {
+	store := NewMemoryStore()
+	logger := NewLogger(store, time.Hour)
+	defer logger.Stop()
+
+	ctx := WithProperties(context.Background(), map[string]interface{}{"user_id": "u1", "tenant": "acme"})
+	ctx = WithProperty(ctx, "tenant", "globex")
+
+	err := logger.EmitContext(ctx, Event{Key: "purchase", Data: map[string]interface{}{"user_id": "explicit", "amount": 10}})
+	if err != nil {
+		t.Fatalf("Failed to emit event: %v", err)
+	}
+	logger.Flush()
+
+	events, err := store.QueryEvents(Query{})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+
+	data := events[0].Data
+	if data["tenant"] != "globex" {
+		t.Errorf("Expected the later tenant property, got %v", data["tenant"])
+	}
+	if data["user_id"] != "explicit" {
+		t.Errorf("Expected event data to take precedence over properties, got %v", data["user_id"])
+	}
+	if data["amount"] != 10 {
+		t.Errorf("Expected event data to be kept, got %v", data)
+	}
+
+	// The parent context is not changed
+	if len(Properties(context.Background())) != 0 {
+		t.Error("Expected no properties on a plain context")
+	}
+}
+
+func TestGinContextProperties(t *testing.T) {
+	emitter := &testEmitter{}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(GinMiddleware(&testEmitter{}), GinContextProperties(func(c *gin.Context) map[string]interface{} {
+		return map[string]interface{}{"tenant": c.GetHeader("X-Tenant")}
+	}))
+	r.GET("/orders", func(c *gin.Context) {
+		EmitContext(c.Request.Context(), emitter, Event{Key: "order_list"})
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("GET", "/orders", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-Request-ID", "req-1")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(emitter.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(emitter.events))
+	}
+	if emitter.events[0].Data["tenant"] != "acme" || emitter.events[0].Data["request_id"] != "req-1" {
+		t.Errorf("Expected tenant and request ID from the context, got %v", emitter.events[0].Data)
+	}
+}
@@ -0,0 +1,152 @@
+package tlytics
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader is the default header carrying the request ID
+const RequestIDHeader = "X-Request-ID"
+
+// correlationKey is the gin.Context key of the request's Correlation
+const correlationKey = "tlytics_correlation"
+
+// maxRequestIDLength limits request IDs taken from clients
+const maxRequestIDLength = 128
+
+// Correlation holds the IDs that join analytics events to logs and traces
+type Correlation struct {
+	RequestID string
+	TraceID   string // From the W3C traceparent header
+	SpanID    string // From the W3C traceparent header
+}
+
+// addTo adds the non-empty IDs to the event data
+func (c Correlation) addTo(data map[string]interface{}) {
+	if c.RequestID != "" {
+		data["request_id"] = c.RequestID
+	}
+	if c.TraceID != "" {
+		data["trace_id"] = c.TraceID
+	}
+	if c.SpanID != "" {
+		data["span_id"] = c.SpanID
+	}
+}
+
+// correlationFromRequest reads the request ID from the header, generating one
+// if it is missing or invalid, and the trace and span IDs from traceparent
+func correlationFromRequest(r *http.Request, header string) Correlation {
+	corr := Correlation{RequestID: r.Header.Get(header)}
+	if !validRequestID(corr.RequestID) {
+		corr.RequestID = newRequestID()
+	}
+
+	corr.TraceID, corr.SpanID = parseTraceparent(r.Header.Get("traceparent"))
+
+	return corr
+}
+
+// validRequestID accepts IDs of printable ASCII without spaces
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// parseTraceparent returns the trace and span IDs of a W3C traceparent header
+// like 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(value string) (string, string) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return "", ""
+	}
+
+	version, traceID, spanID := parts[0], parts[1], parts[2]
+	if len(version) != 2 || version == "ff" || !isLowerHex(version) {
+		return "", ""
+	}
+	// Version 00 has exactly four fields, later versions may add more
+	if version == "00" && len(parts) != 4 {
+		return "", ""
+	}
+	if len(traceID) != 32 || !isLowerHex(traceID) || strings.Trim(traceID, "0") == "" {
+		return "", ""
+	}
+	if len(spanID) != 16 || !isLowerHex(spanID) || strings.Trim(spanID, "0") == "" {
+		return "", ""
+	}
+
+	return traceID, spanID
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// GetCorrelation returns the correlation IDs GinMiddleware set for the request
+func GetCorrelation(c *gin.Context) (Correlation, bool) {
+	value, ok := c.Get(correlationKey)
+	if !ok {
+		return Correlation{}, false
+	}
+	corr, ok := value.(Correlation)
+	return corr, ok
+}
+
+// RequestID returns the request ID GinMiddleware set for the request
+func RequestID(c *gin.Context) string {
+	corr, _ := GetCorrelation(c)
+	return corr.RequestID
+}
+
+// ginEmitter adds the request's correlation IDs to every event
+type ginEmitter struct {
+	emitter Emitter
+	corr    Correlation
+}
+
+func (e ginEmitter) Emit(event Event) error {
+	data := make(map[string]interface{}, len(event.Data)+3)
+	for k, v := range event.Data {
+		data[k] = v
+	}
+	e.corr.addTo(data)
+	event.Data = data
+
+	return e.emitter.Emit(event)
+}
+
+// GinEmitter returns an Emitter for use in a handler that adds the request's
+// correlation IDs to every event
+//
+//	tlytics.GinEmitter(c, analytics).Emit(tlytics.Event{Key: "signup"})
+func GinEmitter(c *gin.Context, analytics Emitter) Emitter {
+	corr, ok := GetCorrelation(c)
+	if !ok {
+		return analytics
+	}
+	return ginEmitter{emitter: analytics, corr: corr}
+}
@@ -0,0 +1,86 @@
+package tlytics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		traceID string
+		spanID  string
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", ""},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", ""},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", ""},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", ""},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", ""},
+		{"garbage", "", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		traceID, spanID := parseTraceparent(test.value)
+		if traceID != test.traceID || spanID != test.spanID {
+			t.Errorf("parseTraceparent(%q) = %q, %q, expected %q, %q", test.value, traceID, spanID, test.traceID, test.spanID)
+		}
+	}
+}
+
+func TestGinMiddlewareCorrelation(t *testing.T) {
+	emitter := &testEmitter{}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(GinMiddleware(emitter))
+	r.GET("/signup", func(c *gin.Context) {
+		GinEmitter(c, emitter).Emit(Event{Key: "signup", Data: map[string]interface{}{"plan": "pro"}})
+		c.String(http.StatusOK, RequestID(c))
+	})
+
+	// Request and trace IDs from the client
+	req := httptest.NewRequest("GET", "/signup", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Header().Get("X-Request-ID") != "req-123" || w.Body.String() != "req-123" {
+		t.Errorf("Expected request ID req-123 in header and handler, got %q and %q", w.Header().Get("X-Request-ID"), w.Body.String())
+	}
+
+	if len(emitter.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(emitter.events))
+	}
+	for _, event := range emitter.events {
+		if event.Data["request_id"] != "req-123" || event.Data["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || event.Data["span_id"] != "00f067aa0ba902b7" {
+			t.Errorf("Expected correlation fields in %s event, got %v", event.Key, event.Data)
+		}
+	}
+	if emitter.events[0].Data["plan"] != "pro" {
+		t.Errorf("Expected handler event data to be kept, got %v", emitter.events[0].Data)
+	}
+
+	// Generated request ID, invalid client IDs are replaced
+	req = httptest.NewRequest("GET", "/signup", nil)
+	req.Header.Set("X-Request-ID", "has spaces")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	generated := w.Header().Get("X-Request-ID")
+	if len(generated) != 32 {
+		t.Errorf("Expected a generated request ID, got %q", generated)
+	}
+	if emitter.events[3].Data["request_id"] != generated {
+		t.Errorf("Expected generated request ID in the event, got %v", emitter.events[3].Data["request_id"])
+	}
+	if _, ok := emitter.events[3].Data["trace_id"]; ok {
+		t.Error("Expected no trace ID without traceparent")
+	}
+}
@@ -4,15 +4,24 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"sync"
+	"runtime"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// busyTimeout is how long SQLite waits for a lock before returning SQLITE_BUSY
+const busyTimeout = 5 * time.Second
+
+// DB is the SQLite store. The database runs in WAL mode with a single writer
+// connection and a pool of read-only connections, so queries don't block
+// inserts and the other way around.
 type DB struct {
-	conn  *sql.DB
-	path  string
-	mutex sync.Mutex
+	writer *sql.DB
+	reader *sql.DB
+	path   string
+	hot    hotFields // Data fields with a generated column and index per key, see SetHotFields
 }
 
 func Init(dbPath string) (*DB, error) {
@@ -22,21 +31,58 @@ func Init(dbPath string) (*DB, error) {
 		return nil, err
 	}
 
-	conn, err := sql.Open("sqlite3", dbPath)
+	writer, err := sql.Open("sqlite3", db.dsn(false))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	// SQLite allows one writer at a time, a single connection serializes writes
+	writer.SetMaxOpenConns(1)
 
-	db.conn = conn
+	db.writer = writer
 
 	if err := db.createTableIfNotExists(); err != nil {
-		conn.Close()
+		writer.Close()
 		return nil, err
 	}
 
+	if db.inMemory() {
+		// Every connection to :memory: is a separate database
+		db.reader = writer
+		return db, nil
+	}
+
+	reader, err := sql.Open("sqlite3", db.dsn(true))
+	if err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	reader.SetMaxOpenConns(runtime.NumCPU())
+
+	db.reader = reader
+
 	return db, nil
 }
 
+func (db *DB) inMemory() bool {
+	return db.path == "" || db.path == ":memory:"
+}
+
+// dsn returns the connection string for the writer or the read-only pool
+func (db *DB) dsn(readOnly bool) string {
+	if db.inMemory() {
+		return db.path
+	}
+
+	params := fmt.Sprintf("_busy_timeout=%d", busyTimeout.Milliseconds())
+	if readOnly {
+		params += "&mode=ro"
+	} else {
+		params += "&_journal_mode=WAL&_synchronous=NORMAL&_txlock=immediate"
+	}
+
+	return "file:" + db.path + "?" + params
+}
+
 func (db *DB) createDBIfNotExists() error {
 	// For DuckDB, we don't need to pre-create the file
 	// DuckDB will create it automatically when we connect
@@ -49,9 +95,25 @@ func (db *DB) createTableIfNotExists() error {
 		key TEXT NOT NULL,
 		timestamp DATETIME NOT NULL,
 		data TEXT
+	);
+	CREATE TABLE IF NOT EXISTS tlytics_sketches (
+		key TEXT NOT NULL,
+		field TEXT NOT NULL,
+		start INTEGER NOT NULL,
+		registers BLOB NOT NULL,
+		PRIMARY KEY (key, field, start)
+	);
+	CREATE TABLE IF NOT EXISTS tlytics_erasures (
+		field TEXT NOT NULL,
+		value_hash TEXT NOT NULL,
+		deleted INTEGER NOT NULL,
+		batches INTEGER NOT NULL,
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME NOT NULL,
+		error TEXT NOT NULL
 	);`
 
-	_, err := db.conn.Exec(query)
+	_, err := db.writer.Exec(query)
 	if err != nil {
 		return fmt.Errorf("failed to create table: %w", err)
 	}
@@ -59,18 +121,78 @@ func (db *DB) createTableIfNotExists() error {
 	return nil
 }
 
+// SetHotFields adds a generated column holding the text of each hot field,
+// as compared by Query.Field, and a partial index on column and timestamp
+// for each key the field is hot for. Virtual columns need no rewrite of
+// existing rows, the index entries are computed on insert. Columns and
+// indexes no longer configured are left in place.
+func (db *DB) SetHotFields(fields map[string][]string) error {
+	hot, err := hotFieldSet(fields)
+	if err != nil {
+		return err
+	}
+
+	// table_xinfo lists generated columns too
+	rows, err := db.writer.Query("SELECT name FROM pragma_table_xinfo('tlytics')")
+	if err != nil {
+		return fmt.Errorf("failed to read columns: %w", err)
+	}
+	// Column names are case-insensitive
+	existing := make(map[string]string)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read columns: %w", err)
+		}
+		existing[strings.ToLower(name)] = name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read columns: %w", err)
+	}
+
+	for _, field := range hot.columns() {
+		column := hotColumn(field)
+		name, ok := existing[strings.ToLower(column)]
+		if ok && name != column {
+			return fmt.Errorf("hot field %q collides with column %s of a field differing only in case", field, name)
+		}
+		if !ok {
+			statement := fmt.Sprintf(
+				"ALTER TABLE tlytics ADD COLUMN %s TEXT GENERATED ALWAYS AS (%s) VIRTUAL",
+				column, jsonText("'"+jsonPath(field)+"'"),
+			)
+			if _, err := db.writer.Exec(statement); err != nil {
+				return fmt.Errorf("failed to add column %s: %w", column, err)
+			}
+		}
+
+		for _, key := range hot.keys(field) {
+			if _, err := db.writer.Exec(hotIndex(field, key)); err != nil {
+				return fmt.Errorf("failed to index column %s: %w", column, err)
+			}
+		}
+	}
+
+	db.hot = hot
+	return nil
+}
+
 func (db *DB) Close() error {
-	if db.conn != nil {
-		return db.conn.Close()
+	if db.reader != nil && db.reader != db.writer {
+		if err := db.reader.Close(); err != nil {
+			return err
+		}
+	}
+	if db.writer != nil {
+		return db.writer.Close()
 	}
 	return nil
 }
 
 func (db *DB) InsertEvents(events []Event) error {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-
-	tx, err := db.conn.Begin()
+	tx, err := db.writer.Begin()
 	if err != nil {
 		return err
 	}
@@ -88,7 +210,7 @@ func (db *DB) InsertEvents(events []Event) error {
 			return err
 		}
 
-		_, err = stmt.Exec(event.Key, event.Timestamp, string(dataJSON))
+		_, err = stmt.Exec(event.Key, event.Timestamp.UTC(), string(dataJSON))
 		if err != nil {
 			return err
 		}
@@ -98,22 +220,312 @@ func (db *DB) InsertEvents(events []Event) error {
 }
 
 func (db *DB) GetEvents(limit, offset int) ([]Event, int, error) {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
+	// Read the count and the page from the same snapshot
+	tx, err := db.reader.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
 
 	// Get total count
-	var totalCount int
-	err := db.conn.QueryRow("SELECT COUNT(*) FROM tlytics").Scan(&totalCount)
+	totalCount, err := db.countEvents(tx, Query{})
 	if err != nil {
 		return nil, 0, err
 	}
 
 	// Get paginated events
-	query := "SELECT key, timestamp, data FROM tlytics ORDER BY timestamp DESC LIMIT ? OFFSET ?"
-	rows, err := db.conn.Query(query, limit, offset)
+	events, err := db.queryEvents(tx, Query{Limit: limit, Offset: offset})
 	if err != nil {
 		return nil, 0, err
 	}
+
+	return events, totalCount, nil
+}
+
+func (db *DB) QueryEvents(q Query) ([]Event, error) {
+	return db.queryEvents(db.reader, q)
+}
+
+func (db *DB) CountEvents(q Query) (int, error) {
+	return db.countEvents(db.reader, q)
+}
+
+func (db *DB) Aggregate(q Query, interval time.Duration) ([]AggregateBucket, error) {
+	if interval < time.Second {
+		return nil, fmt.Errorf("aggregate interval must be at least 1s, got %s", interval)
+	}
+
+	where, args := db.whereClause(q)
+	seconds := int64(interval / time.Second)
+	query := "SELECT key, CAST(strftime('%s', timestamp) AS INTEGER) / ? * ? AS bucket, COUNT(*) FROM tlytics" +
+		where + " GROUP BY key, bucket ORDER BY bucket, key"
+
+	rows, err := db.reader.Query(query, append([]interface{}{seconds, seconds}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make([]AggregateBucket, 0)
+	for rows.Next() {
+		var bucket AggregateBucket
+		var start int64
+
+		if err := rows.Scan(&bucket.Key, &start, &bucket.Count); err != nil {
+			return nil, err
+		}
+
+		bucket.Start = time.Unix(start, 0).UTC()
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, rows.Err()
+}
+
+// Breakdown groups the events matching the query with SQLite's JSON functions.
+// At most Limit groups are returned, Offset is ignored.
+func (db *DB) Breakdown(q Query, b Breakdown) ([]BreakdownGroup, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	var columns, groupBy, notNull []string
+	var args []interface{}
+	for i, field := range b.Fields {
+		if db.hot.has(q.Key, field) {
+			columns = append(columns, fmt.Sprintf("%s AS v%d", hotColumn(field), i))
+		} else {
+			columns = append(columns, fmt.Sprintf("%s AS v%d", jsonText("?"), i))
+			args = append(args, jsonPath(field), jsonPath(field))
+		}
+		groupBy = append(groupBy, fmt.Sprintf("v%d", i))
+		notNull = append(notNull, fmt.Sprintf("v%d IS NOT NULL", i))
+	}
+
+	if b.Sum != "" {
+		// Only JSON numbers are summed, SUM would take text as 0
+		columns = append(columns, "CASE WHEN json_type(data, ?) IN ('integer', 'real') THEN json_extract(data, ?) END AS n")
+		args = append(args, jsonPath(b.Sum), jsonPath(b.Sum))
+	} else {
+		columns = append(columns, "NULL AS n")
+	}
+
+	where, whereArgs := db.whereClause(q)
+	args = append(args, whereArgs...)
+
+	order := "COUNT(*) DESC"
+	switch b.OrderBy {
+	case OrderBySum:
+		order = "TOTAL(n) DESC"
+	case OrderByAvg:
+		order = "AVG(n) DESC"
+	}
+
+	// SQLite needs a LIMIT for OFFSET, -1 means no limit
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	args = append(args, limit)
+
+	query := "SELECT " + strings.Join(groupBy, ", ") + ", COUNT(*), TOTAL(n), COUNT(n) FROM (SELECT " +
+		strings.Join(columns, ", ") + " FROM tlytics" + where + ") WHERE " + strings.Join(notNull, " AND ") +
+		" GROUP BY " + strings.Join(groupBy, ", ") + " ORDER BY " + order + ", " + strings.Join(groupBy, ", ") + " LIMIT ?"
+
+	rows, err := db.reader.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]BreakdownGroup, 0)
+	for rows.Next() {
+		group := BreakdownGroup{Values: make([]string, len(b.Fields))}
+		var sum float64
+
+		dest := make([]interface{}, 0, len(b.Fields)+3)
+		for i := range group.Values {
+			dest = append(dest, &group.Values[i])
+		}
+		dest = append(dest, &group.Count, &sum, &group.numeric)
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		if b.Sum != "" {
+			group.Sum = &sum
+			group.setAvg()
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+// DeleteEvents removes the events matching the query filters. A Limit caps the
+// number of deleted events, so large deletes can be split into short
+// transactions. Offset is ignored.
+func (db *DB) DeleteEvents(q Query) (int64, error) {
+	where, args := db.whereClause(q)
+	query := "DELETE FROM tlytics" + where
+	if q.Limit > 0 {
+		query = "DELETE FROM tlytics WHERE rowid IN (SELECT rowid FROM tlytics" + where + " LIMIT ?)"
+		args = append(args, q.Limit)
+	}
+
+	result, err := db.writer.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// MergeSketches merges the sketches into the stored ones in one transaction
+func (db *DB) MergeSketches(sketches []Sketch) error {
+	tx, err := db.writer.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, sketch := range sketches {
+		hll := NewHyperLogLog()
+		hll.Merge(sketch.HLL)
+
+		var stored []byte
+		err := tx.QueryRow("SELECT registers FROM tlytics_sketches WHERE key = ? AND field = ? AND start = ?",
+			sketch.Key, sketch.Field, sketch.Start.Unix()).Scan(&stored)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return err
+		default:
+			existing := NewHyperLogLog()
+			if err := existing.UnmarshalBinary(stored); err != nil {
+				return err
+			}
+			hll.Merge(existing)
+		}
+
+		registers, err := hll.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT OR REPLACE INTO tlytics_sketches (key, field, start, registers) VALUES (?, ?, ?, ?)",
+			sketch.Key, sketch.Field, sketch.Start.Unix(), registers)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// QuerySketches returns the sketches of the field starting in the query's time range
+func (db *DB) QuerySketches(q Query, field string) ([]Sketch, error) {
+	query := "SELECT key, start, registers FROM tlytics_sketches WHERE field = ?"
+	args := []interface{}{field}
+	if q.Key != "" {
+		query += " AND key = ?"
+		args = append(args, q.Key)
+	}
+	if !q.From.IsZero() {
+		query += " AND start >= ?"
+		args = append(args, q.From.Unix())
+	}
+	if !q.To.IsZero() {
+		query += " AND start < ?"
+		args = append(args, q.To.Unix())
+	}
+
+	rows, err := db.reader.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sketches []Sketch
+	for rows.Next() {
+		var sketch Sketch
+		var start int64
+		var registers []byte
+
+		if err := rows.Scan(&sketch.Key, &start, &registers); err != nil {
+			return nil, err
+		}
+
+		sketch.Field = field
+		sketch.Start = time.Unix(start, 0).UTC()
+		sketch.HLL = NewHyperLogLog()
+		if err := sketch.HLL.UnmarshalBinary(registers); err != nil {
+			return nil, err
+		}
+		sketches = append(sketches, sketch)
+	}
+
+	return sketches, rows.Err()
+}
+
+// InsertErasure stores the record of an erasure
+func (db *DB) InsertErasure(record ErasureRecord) error {
+	_, err := db.writer.Exec("INSERT INTO tlytics_erasures (field, value_hash, deleted, batches, started_at, finished_at, error) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		record.Field, record.ValueHash, record.Deleted, record.Batches, record.StartedAt.UTC(), record.FinishedAt.UTC(), record.Error)
+	return err
+}
+
+// Erasures returns the stored erasure records, newest first
+func (db *DB) Erasures() ([]ErasureRecord, error) {
+	rows, err := db.reader.Query("SELECT field, value_hash, deleted, batches, started_at, finished_at, error FROM tlytics_erasures ORDER BY finished_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]ErasureRecord, 0)
+	for rows.Next() {
+		var r ErasureRecord
+		if err := rows.Scan(&r.Field, &r.ValueHash, &r.Deleted, &r.Batches, &r.StartedAt, &r.FinishedAt, &r.Error); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+// querier is implemented by *sql.DB and *sql.Tx
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (db *DB) countEvents(conn querier, q Query) (int, error) {
+	where, args := db.whereClause(q)
+
+	var count int
+	err := conn.QueryRow("SELECT COUNT(*) FROM tlytics"+where, args...).Scan(&count)
+	return count, err
+}
+
+func (db *DB) queryEvents(conn querier, q Query) ([]Event, error) {
+	where, args := db.whereClause(q)
+	query := "SELECT key, timestamp, data FROM tlytics" + where + " ORDER BY timestamp DESC"
+
+	// SQLite needs a LIMIT for OFFSET, -1 means no limit
+	limit := q.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, limit, q.Offset)
+
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var events []Event
@@ -123,20 +535,56 @@ func (db *DB) GetEvents(limit, offset int) ([]Event, int, error) {
 
 		err := rows.Scan(&event.Key, &event.Timestamp, &dataJSON)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 
 		// Parse JSON data
 		if err := json.Unmarshal([]byte(dataJSON), &event.Data); err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 
 		events = append(events, event)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	return events, totalCount, nil
+	return events, nil
+}
+
+// whereClause builds the WHERE part of a statement for the query filters.
+// Timestamps are stored in UTC so they compare correctly as text.
+func (db *DB) whereClause(q Query) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if q.Key != "" {
+		conds = append(conds, "key = ?")
+		args = append(args, q.Key)
+	}
+	if !q.From.IsZero() {
+		conds = append(conds, "timestamp >= ?")
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, "timestamp < ?")
+		args = append(args, q.To.UTC())
+	}
+	if q.ExcludeBots {
+		conds = append(conds, "COALESCE(json_extract(data, '$.is_bot'), 0) = 0")
+	}
+	if q.Field != "" && db.hot.has(q.Key, q.Field) {
+		conds = append(conds, hotColumn(q.Field)+" = ?")
+		args = append(args, q.Value)
+	} else if q.Field != "" {
+		conds = append(conds, jsonText("?")+" = ?")
+		args = append(args, jsonPath(q.Field), jsonPath(q.Field), q.Value)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+
+	return " WHERE " + strings.Join(conds, " AND "), args
 }
@@ -0,0 +1,66 @@
+package tlytics
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadsDoNotWaitForWriter(t *testing.T) {
+	dbPath := "./test_wal.duckdb"
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	db, err := Init(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	var journalMode string
+	if err := db.writer.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		t.Fatalf("Failed to read journal mode: %v", err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("Expected wal journal mode, got %s", journalMode)
+	}
+
+	if err := db.InsertEvents([]Event{{Key: "committed", Timestamp: time.Now()}}); err != nil {
+		t.Fatalf("Failed to insert events: %v", err)
+	}
+
+	// Hold the write lock with an uncommitted insert
+	tx, err := db.writer.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO tlytics (key, timestamp, data) VALUES (?, ?, ?)", "pending", time.Now().UTC(), "{}"); err != nil {
+		t.Fatalf("Failed to insert in transaction: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		events, total, err := db.GetEvents(10, 0)
+		if err == nil && (total != 1 || len(events) != 1 || events[0].Key != "committed") {
+			t.Errorf("Expected only the committed event, got %d events: %v", total, events)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Failed to read while writing: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read blocked by open write transaction")
+	}
+
+	// Writes are rejected on the read-only pool
+	if _, err := db.reader.Exec("DELETE FROM tlytics"); err == nil {
+		t.Error("Expected write on read-only connection to fail")
+	}
+}
@@ -0,0 +1,68 @@
+package tlytics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// EchoMiddleware emits the same http_request events as GinMiddleware for echo,
+// with echo route templates like /users/:id
+func EchoMiddleware(analytics Emitter, opts MiddlewareOptions) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if opts.skip(r.URL.Path) {
+				return next(c)
+			}
+
+			start := time.Now()
+
+			emit := func(status int, panicked bool, err error) {
+				route := c.Path()
+				if route == "" {
+					route = UnmatchedRoute
+				}
+
+				if !opts.sampled(route) {
+					return
+				}
+
+				info := requestInfo{
+					start:          start,
+					request:        r,
+					responseHeader: c.Response().Header(),
+					route:          route,
+					status:         status,
+					size:           int(c.Response().Size),
+					clientIP:       opts.clientIP(r),
+					panicked:       panicked,
+				}
+
+				if err != nil {
+					info.errors = []string{err.Error()}
+				}
+
+				analytics.Emit(opts.requestEvent(info))
+			}
+
+			defer func() {
+				if err := recover(); err != nil {
+					emit(http.StatusInternalServerError, true, nil)
+					panic(err)
+				}
+			}()
+
+			err := next(c)
+			if err != nil {
+				// Let echo write the error response so the status is known
+				c.Error(err)
+			}
+
+			emit(c.Response().Status, false, err)
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package tlytics
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+)
+
+// copyEvent returns the event with a deep copy of its data, so emitters and
+// processors that change the data don't affect each other or the caller
+func copyEvent(event Event) Event {
+	if event.Data == nil {
+		return event
+	}
+
+	event.Data = copyValue(event.Data).(map[string]interface{})
+
+	return event
+}
+
+// copyValue copies maps and slices in v recursively, other values are shared
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			copied[k] = copyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	case map[string]string:
+		copied := make(map[string]string, len(v))
+		for k, item := range v {
+			copied[k] = item
+		}
+		return copied
+	case []string:
+		return append([]string(nil), v...)
+	}
+	return v
+}
+
+// MultiEmitter sends every event to all its emitters
+type MultiEmitter struct {
+	emitters []Emitter
+}
+
+func NewMultiEmitter(emitters ...Emitter) *MultiEmitter {
+	return &MultiEmitter{emitters: emitters}
+}
+
+// Emit sends the event to every emitter, also when some of them fail, and returns the joined errors
+func (m *MultiEmitter) Emit(event Event) error {
+	var errs []error
+	for _, emitter := range m.emitters {
+		if err := emitter.Emit(copyEvent(event)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FilterEmitter passes on only the events the predicate keeps
+type FilterEmitter struct {
+	next Emitter
+	keep func(Event) bool
+}
+
+func NewFilterEmitter(next Emitter, keep func(Event) bool) *FilterEmitter {
+	return &FilterEmitter{next: next, keep: keep}
+}
+
+func (f *FilterEmitter) Emit(event Event) error {
+	if !f.keep(event) {
+		return nil
+	}
+	return f.next.Emit(event)
+}
+
+// DropKeys is a FilterEmitter predicate dropping events with the keys
+func DropKeys(keys ...string) func(Event) bool {
+	drop := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		drop[key] = true
+	}
+	return func(e Event) bool {
+		return !drop[e.Key]
+	}
+}
+
+// SampleEmitter passes on a random fraction of the events of each key.
+// Sampled events get a sample_rate field so counts can be scaled back up.
+type SampleEmitter struct {
+	next        Emitter
+	defaultRate float64
+	rates       map[string]float64
+}
+
+// NewSampleEmitter samples events at the rate for their key in rates, or
+// defaultRate for other keys. A rate of 1 keeps all events and 0 drops all.
+func NewSampleEmitter(next Emitter, defaultRate float64, rates map[string]float64) *SampleEmitter {
+	return &SampleEmitter{
+		next:        next,
+		defaultRate: defaultRate,
+		rates:       rates,
+	}
+}
+
+func (s *SampleEmitter) Emit(event Event) error {
+	rate, ok := s.rates[event.Key]
+	if !ok {
+		rate = s.defaultRate
+	}
+
+	if rate >= 1 {
+		return s.next.Emit(event)
+	}
+	if rate <= 0 || rand.Float64() >= rate {
+		return nil
+	}
+
+	event = copyEvent(event)
+	if event.Data == nil {
+		event.Data = make(map[string]interface{})
+	}
+	event.Data["sample_rate"] = rate
+
+	return s.next.Emit(event)
+}
+
+// NopEmitter discards all events, e.g. to disable analytics in tests
+type NopEmitter struct{}
+
+func (NopEmitter) Emit(Event) error {
+	return nil
+}
+
+// RecordingEmitter keeps the emitted events in memory for assertions in tests.
+// The zero value is ready to use.
+type RecordingEmitter struct {
+	events []Event
+	mutex  sync.Mutex
+}
+
+func (r *RecordingEmitter) Emit(event Event) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.events = append(r.events, copyEvent(event))
+	return nil
+}
+
+// Events returns the events emitted so far
+func (r *RecordingEmitter) Events() []Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]Event(nil), r.events...)
+}
+
+// EventsWithKey returns the events emitted so far with the key
+func (r *RecordingEmitter) EventsWithKey(key string) []Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var events []Event
+	for _, event := range r.events {
+		if event.Key == key {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// Reset forgets the recorded events
+func (r *RecordingEmitter) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.events = nil
+}
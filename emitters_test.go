@@ -0,0 +1,91 @@
+package tlytics
+
+import (
+	"errors"
+	"testing"
+)
+
+type failingEmitter struct{}
+
+func (failingEmitter) Emit(Event) error {
+	return errors.New("unavailable")
+}
+
+func TestMultiEmitter(t *testing.T) {
+	first, second := &RecordingEmitter{}, &RecordingEmitter{}
+	multi := NewMultiEmitter(first, failingEmitter{}, second)
+
+	err := multi.Emit(Event{Key: "signup", Data: map[string]interface{}{"plan": "pro"}})
+	if err == nil || err.Error() != "unavailable" {
+		t.Errorf("Expected the failing emitter's error, got %v", err)
+	}
+
+	// Every emitter gets the event, also after one fails
+	for _, recorder := range []*RecordingEmitter{first, second} {
+		events := recorder.Events()
+		if len(events) != 1 || events[0].Data["plan"] != "pro" {
+			t.Errorf("Expected the signup event, got %v", events)
+		}
+	}
+
+	// Each emitter has its own copy of the data
+	first.Events()[0].Data["plan"] = "changed"
+	if second.Events()[0].Data["plan"] != "pro" {
+		t.Error("Expected emitters not to share event data")
+	}
+}
+
+func TestFilterAndNopEmitter(t *testing.T) {
+	recorder := &RecordingEmitter{}
+	filter := NewFilterEmitter(recorder, DropKeys("debug", "heartbeat"))
+
+	for _, key := range []string{"debug", "signup", "heartbeat", "purchase"} {
+		filter.Emit(Event{Key: key})
+	}
+
+	events := recorder.Events()
+	if len(events) != 2 || events[0].Key != "signup" || events[1].Key != "purchase" {
+		t.Errorf("Expected signup and purchase events, got %v", events)
+	}
+
+	if len(recorder.EventsWithKey("purchase")) != 1 {
+		t.Error("Expected 1 purchase event")
+	}
+
+	recorder.Reset()
+	if len(recorder.Events()) != 0 {
+		t.Error("Expected no events after reset")
+	}
+
+	if err := (NopEmitter{}).Emit(Event{Key: "signup"}); err != nil {
+		t.Errorf("Expected NopEmitter to succeed, got %v", err)
+	}
+}
+
+func TestSampleEmitter(t *testing.T) {
+	recorder := &RecordingEmitter{}
+	sampler := NewSampleEmitter(recorder, 1, map[string]float64{"page_view": 0.25, "debug": 0})
+
+	for i := 0; i < 1000; i++ {
+		sampler.Emit(Event{Key: "page_view"})
+		sampler.Emit(Event{Key: "debug"})
+	}
+	sampler.Emit(Event{Key: "signup"})
+
+	if len(recorder.EventsWithKey("debug")) != 0 {
+		t.Error("Expected all debug events to be dropped")
+	}
+
+	signups := recorder.EventsWithKey("signup")
+	if len(signups) != 1 || signups[0].Data != nil {
+		t.Errorf("Expected the signup event unchanged, got %v", signups)
+	}
+
+	views := recorder.EventsWithKey("page_view")
+	if len(views) < 150 || len(views) > 350 {
+		t.Errorf("Expected about 250 sampled page views, got %d", len(views))
+	}
+	if len(views) > 0 && views[0].Data["sample_rate"] != 0.25 {
+		t.Errorf("Expected sample_rate 0.25, got %v", views[0].Data["sample_rate"])
+	}
+}
@@ -0,0 +1,189 @@
+package tlytics
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultFunnelWindow is the conversion window if none is given
+const DefaultFunnelWindow = 24 * time.Hour
+
+// DefaultMaxFunnelEvents is the most events ComputeFunnel loads if not configured
+const DefaultMaxFunnelEvents = 1000000
+
+// FunnelStep matches events of a key whose data fields equal the filters.
+// Values are compared as text, so 200 matches "200".
+type FunnelStep struct {
+	Key     string                 `json:"key"`
+	Filters map[string]interface{} `json:"filters,omitempty"`
+}
+
+func (s FunnelStep) matches(e Event) bool {
+	if e.Key != s.Key {
+		return false
+	}
+	for field, want := range s.Filters {
+		v, ok := e.Data[field]
+		if !ok || v == nil || fmt.Sprint(v) != fmt.Sprint(want) {
+			return false
+		}
+	}
+	return true
+}
+
+// Funnel defines an ordered funnel. A visitor converts to a step when its
+// events match all steps up to it in order, within Window of the first step.
+type Funnel struct {
+	Steps         []FunnelStep
+	IdentityField string        // Data field identifying the visitor, a hash of client_ip and user_agent if empty
+	Window        time.Duration // DefaultFunnelWindow if 0
+	From          time.Time     // First steps at or after this time, required
+	To            time.Time     // First steps before this time, later steps may follow within the window, required
+	MaxEvents     int           // Most events loaded over all steps, DefaultMaxFunnelEvents if 0
+}
+
+// FunnelStepResult is the number of visitors reaching a step
+type FunnelStepResult struct {
+	FunnelStep
+	Count int `json:"count"`
+	// Count relative to the first step
+	ConversionRate float64 `json:"conversion_rate"`
+	// Count relative to the previous step
+	StepConversionRate float64 `json:"step_conversion_rate"`
+	// Median time from the previous step of the visitors reaching this step
+	MedianSecondsFromPrevious float64 `json:"median_seconds_from_previous"`
+}
+
+// FunnelResult holds the results of each step
+type FunnelResult struct {
+	Steps  []FunnelStepResult `json:"steps"`
+	Window string             `json:"window"`
+}
+
+// funnelPath returns the timestamps of the steps reached from the first step
+// event at start, taking the earliest match of each following step
+func funnelPath(events []Event, start int, steps []FunnelStep, window time.Duration) []time.Time {
+	deadline := events[start].Timestamp.Add(window)
+	times := []time.Time{events[start].Timestamp}
+
+	step := 1
+	for i := start + 1; i < len(events) && step < len(steps); i++ {
+		if events[i].Timestamp.After(deadline) {
+			break
+		}
+		if steps[step].matches(events[i]) {
+			times = append(times, events[i].Timestamp)
+			step++
+		}
+	}
+
+	return times
+}
+
+// ComputeFunnel returns the visitors reaching each step. Each visitor counts
+// once, with the first step event that gets furthest into the funnel. It
+// returns ErrTooManyEvents if the steps match more than MaxEvents events.
+func ComputeFunnel(store Store, funnel Funnel) (FunnelResult, error) {
+	if len(funnel.Steps) == 0 {
+		return FunnelResult{}, fmt.Errorf("funnel has no steps")
+	}
+	if funnel.From.IsZero() || funnel.To.IsZero() {
+		return FunnelResult{}, fmt.Errorf("funnel needs a time range")
+	}
+	remaining := funnel.MaxEvents
+	if remaining <= 0 {
+		remaining = DefaultMaxFunnelEvents
+	}
+	window := funnel.Window
+	if window <= 0 {
+		window = DefaultFunnelWindow
+	}
+
+	// Later steps may happen up to a window after the last first step
+	to := funnel.To.Add(window)
+
+	loaded := make(map[string]bool)
+	byIdentity := make(map[string][]Event)
+	for _, step := range funnel.Steps {
+		if loaded[step.Key] {
+			continue
+		}
+		loaded[step.Key] = true
+
+		events, err := queryEventsMax(store, Query{Key: step.Key, From: funnel.From, To: to}, remaining)
+		if err != nil {
+			return FunnelResult{}, err
+		}
+		remaining -= len(events)
+		for _, e := range events {
+			if identity := identityOf(e, funnel.IdentityField); identity != "" {
+				byIdentity[identity] = append(byIdentity[identity], e)
+			}
+		}
+	}
+
+	counts := make([]int, len(funnel.Steps))
+	durations := make([][]float64, len(funnel.Steps))
+	for _, events := range byIdentity {
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Timestamp.Before(events[j].Timestamp)
+		})
+
+		var best []time.Time
+		for i, e := range events {
+			if !e.Timestamp.Before(funnel.To) {
+				break
+			}
+			if !funnel.Steps[0].matches(e) {
+				continue
+			}
+			if path := funnelPath(events, i, funnel.Steps, window); len(path) > len(best) {
+				best = path
+			}
+			if len(best) == len(funnel.Steps) {
+				break
+			}
+		}
+
+		for step, t := range best {
+			counts[step]++
+			if step > 0 {
+				durations[step] = append(durations[step], t.Sub(best[step-1]).Seconds())
+			}
+		}
+	}
+
+	result := FunnelResult{
+		Steps:  make([]FunnelStepResult, len(funnel.Steps)),
+		Window: window.String(),
+	}
+	for i, step := range funnel.Steps {
+		r := FunnelStepResult{FunnelStep: step, Count: counts[i]}
+		if counts[0] > 0 {
+			r.ConversionRate = float64(counts[i]) / float64(counts[0])
+		}
+		if i == 0 {
+			r.StepConversionRate = r.ConversionRate
+		} else if counts[i-1] > 0 {
+			r.StepConversionRate = float64(counts[i]) / float64(counts[i-1])
+		}
+		r.MedianSecondsFromPrevious = median(durations[i])
+		result.Steps[i] = r
+	}
+
+	return result, nil
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
@@ -0,0 +1,125 @@
+package tlytics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestFunnelEndpoint(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+	event := func(offset time.Duration, key, user string, fields map[string]interface{}) Event {
+		data := map[string]interface{}{"user_id": user}
+		for k, v := range fields {
+			data[k] = v
+		}
+		return Event{Key: key, Timestamp: base.Add(offset), Data: data}
+	}
+	pricing := map[string]interface{}{"path": "/pricing"}
+
+	store := NewMemoryStore()
+	store.InsertEvents([]Event{
+		// u1 converts fully
+		event(0, "page_view", "u1", pricing),
+		event(10*time.Minute, "signup", "u1", nil),
+		event(20*time.Minute, "purchase", "u1", map[string]interface{}{"plan": "pro"}),
+		// u2 signs up, purchases too late
+		event(0, "page_view", "u2", pricing),
+		event(30*time.Minute, "signup", "u2", nil),
+		event(3*time.Hour, "purchase", "u2", map[string]interface{}{"plan": "pro"}),
+		// u3 views another page, then pricing and signs up
+		event(0, "page_view", "u3", map[string]interface{}{"path": "/"}),
+		event(time.Hour, "page_view", "u3", pricing),
+		event(time.Hour+20*time.Minute, "signup", "u3", nil),
+		// u4 signs up before viewing pricing
+		event(0, "signup", "u4", nil),
+		event(time.Minute, "page_view", "u4", pricing),
+	})
+
+	gin.SetMode(gin.TestMode)
+	server := newHTTPServer(nil, store, 0)
+
+	body := `{
+		"steps": [
+			{"key": "page_view", "filters": {"path": "/pricing"}},
+			{"key": "signup"},
+			{"key": "purchase", "filters": {"plan": "pro"}}
+		],
+		"identity": "user_id",
+		"window": "2h",
+		"from": "2025-08-25T00:00:00Z",
+		"to": "2025-08-26T00:00:00Z"
+	}`
+	req := httptest.NewRequest("POST", "/analysis/funnel", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var result FunnelResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	expected := []struct {
+		count  int
+		rate   float64
+		median float64
+	}{
+		{count: 4, rate: 1, median: 0},
+		{count: 3, rate: 0.75, median: 20 * 60},
+		{count: 1, rate: 0.25, median: 10 * 60},
+	}
+	if len(result.Steps) != len(expected) {
+		t.Fatalf("Expected %d steps, got %d", len(expected), len(result.Steps))
+	}
+	for i, e := range expected {
+		step := result.Steps[i]
+		if step.Count != e.count || step.ConversionRate != e.rate || step.MedianSecondsFromPrevious != e.median {
+			t.Errorf("Step %d: expected %+v, got %+v", i, e, step)
+		}
+	}
+	if result.Steps[2].StepConversionRate != 1.0/3 {
+		t.Errorf("Expected a step conversion rate of 1/3, got %v", result.Steps[2].StepConversionRate)
+	}
+
+	req = httptest.NewRequest("POST", "/analysis/funnel", strings.NewReader(`{"steps": []}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without steps, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/analysis/funnel", strings.NewReader(`{"steps": [{"key": "signup"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a time range, got %d", w.Code)
+	}
+
+	// The steps load 5 page views and 4 signups
+	funnel := Funnel{
+		Steps:         []FunnelStep{{Key: "page_view"}, {Key: "signup"}},
+		IdentityField: "user_id",
+		From:          base,
+		To:            base.Add(24 * time.Hour),
+		MaxEvents:     8,
+	}
+	if _, err := ComputeFunnel(store, funnel); err != ErrTooManyEvents {
+		t.Errorf("Expected ErrTooManyEvents, got %v", err)
+	}
+	funnel.MaxEvents = 9
+	if _, err := ComputeFunnel(store, funnel); err != nil {
+		t.Errorf("Expected the funnel to fit in 9 events, got %v", err)
+	}
+}
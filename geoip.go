@@ -0,0 +1,191 @@
+package tlytics
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// defaultGeoIPReloadInterval is how often the GeoIP files are checked for changes
+const defaultGeoIPReloadInterval = time.Minute
+
+// geoRecord holds the fields used from GeoIP2/GeoLite2 City, Country and ASN databases
+type geoRecord struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// GeoIP looks up IP addresses in local MaxMind format databases, so no IP
+// leaves the server. The files are read again when they change.
+type GeoIP struct {
+	databases []*geoDatabase
+}
+
+type geoDatabase struct {
+	path    string
+	reader  *maxminddb.Reader
+	modTime time.Time
+	size    int64
+	mutex   sync.RWMutex
+}
+
+// NewGeoIP opens the databases, e.g. GeoLite2-City.mmdb and GeoLite2-ASN.mmdb
+func NewGeoIP(paths ...string) (*GeoIP, error) {
+	g := &GeoIP{}
+	for _, path := range paths {
+		db := &geoDatabase{path: path}
+		if _, err := db.reload(); err != nil {
+			return nil, err
+		}
+		g.databases = append(g.databases, db)
+	}
+	return g, nil
+}
+
+// reload reads the file if it changed since it was last read. The file is
+// read into memory, so it can be overwritten in place while in use. A file
+// that fails to open, e.g. while it is being copied, keeps the old data.
+func (d *geoDatabase) reload() (bool, error) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat GeoIP database: %w", err)
+	}
+
+	d.mutex.RLock()
+	unchanged := d.reader != nil && info.ModTime().Equal(d.modTime) && info.Size() == d.size
+	d.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read GeoIP database: %w", err)
+	}
+
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to open GeoIP database %s: %w", d.path, err)
+	}
+
+	d.mutex.Lock()
+	d.reader = reader
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+	d.mutex.Unlock()
+
+	return true, nil
+}
+
+func (d *geoDatabase) lookup(ip net.IP, record *geoRecord) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.reader.Lookup(ip, record)
+}
+
+// Reload reads the databases whose files changed and returns how many were reloaded
+func (g *GeoIP) Reload() (int, error) {
+	reloaded := 0
+	var errs []error
+	for _, db := range g.databases {
+		ok, err := db.reload()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if ok {
+			reloaded++
+		}
+	}
+	return reloaded, errors.Join(errs...)
+}
+
+// Lookup returns the country, country_name, region, city, asn and as_org
+// fields found for the IP. Fields missing from the databases are left out.
+func (g *GeoIP) Lookup(ip net.IP) map[string]interface{} {
+	var record geoRecord
+	for _, db := range g.databases {
+		// Each database fills the fields it has, e.g. City and ASN databases
+		db.lookup(ip, &record)
+	}
+
+	fields := make(map[string]interface{})
+	if record.Country.ISOCode != "" {
+		fields["country"] = record.Country.ISOCode
+	}
+	if name := record.Country.Names["en"]; name != "" {
+		fields["country_name"] = name
+	}
+	if len(record.Subdivisions) > 0 && record.Subdivisions[0].Names["en"] != "" {
+		fields["region"] = record.Subdivisions[0].Names["en"]
+	}
+	if name := record.City.Names["en"]; name != "" {
+		fields["city"] = name
+	}
+	if record.ASN != 0 {
+		fields["asn"] = record.ASN
+	}
+	if record.ASOrg != "" {
+		fields["as_org"] = record.ASOrg
+	}
+
+	return fields
+}
+
+// Processor returns a processor adding the Lookup fields of client_ip to events.
+// It must run before processors that anonymize the IP. Fields already in the
+// event are kept.
+func (g *GeoIP) Processor() Processor {
+	return func(e *Event) bool {
+		s, ok := e.Data["client_ip"].(string)
+		if !ok {
+			return true
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return true
+		}
+
+		for k, v := range g.Lookup(ip) {
+			if _, ok := e.Data[k]; !ok {
+				e.Data[k] = v
+			}
+		}
+		return true
+	}
+}
+
+// reloadWorker checks the files for changes every period until stopCh is closed
+func (g *GeoIP) reloadWorker(period time.Duration, stopCh chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := g.Reload(); err != nil {
+				// In a production system, you might want to log this error
+				_ = err
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
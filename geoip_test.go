@@ -0,0 +1,179 @@
+package tlytics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// mmdbValue encodes a value in the MaxMind DB data format. Only the types
+// needed by the tests are supported, and sizes must be below 285.
+func mmdbValue(v interface{}) []byte {
+	control := func(typ, size int) []byte {
+		var extra []byte
+		if size >= 29 {
+			extra = []byte{byte(size - 29)}
+			size = 29
+		}
+		if typ <= 7 {
+			return append([]byte{byte(typ<<5 | size)}, extra...)
+		}
+		return append([]byte{byte(size), byte(typ - 7)}, extra...)
+	}
+
+	switch v := v.(type) {
+	case string:
+		return append(control(2, len(v)), v...)
+	case uint16:
+		return append(control(5, 2), byte(v>>8), byte(v))
+	case uint32:
+		b := binary.BigEndian.AppendUint32(nil, v)
+		return append(control(6, 4), b...)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b := control(7, len(v))
+		for _, k := range keys {
+			b = append(b, mmdbValue(k)...)
+			b = append(b, mmdbValue(v[k])...)
+		}
+		return b
+	case []interface{}:
+		b := control(11, len(v))
+		for _, item := range v {
+			b = append(b, mmdbValue(item)...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// writeMMDB writes an IPv4 database with one /24 network holding the record
+func writeMMDB(t *testing.T, path string, network *net.IPNet, record map[string]interface{}) {
+	t.Helper()
+
+	ones, _ := network.Mask.Size()
+	ip := network.IP.To4()
+	nodeCount := uint32(ones)
+
+	// One node per bit of the network, the other branch of each is empty
+	record24 := func(b []byte, v uint32) []byte {
+		return append(b, byte(v>>16), byte(v>>8), byte(v))
+	}
+	var tree []byte
+	for i := 0; i < ones; i++ {
+		next := uint32(i + 1)
+		if i == ones-1 {
+			next = nodeCount + 16 // Data section offset 0
+		}
+		left, right := nodeCount, next
+		if ip[i/8]&(0x80>>(i%8)) == 0 {
+			left, right = next, nodeCount
+		}
+		tree = record24(tree, left)
+		tree = record24(tree, right)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(tree)
+	buf.Write(make([]byte, 16))
+	buf.Write(mmdbValue(record))
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	buf.Write(mmdbValue(map[string]interface{}{
+		"node_count":                  nodeCount,
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "Test",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+	}))
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write test database: %v", err)
+	}
+}
+
+func cityRecord(country, region, city string) map[string]interface{} {
+	return map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": country},
+		"subdivisions": []interface{}{map[string]interface{}{"names": map[string]interface{}{"en": region}}},
+		"city":         map[string]interface{}{"names": map[string]interface{}{"en": city}},
+	}
+}
+
+func TestGeoIPLookupAndReload(t *testing.T) {
+	dir := t.TempDir()
+	cityPath := filepath.Join(dir, "city.mmdb")
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	_, network, _ := net.ParseCIDR("81.2.69.0/24")
+
+	writeMMDB(t, cityPath, network, cityRecord("GB", "England", "London"))
+	writeMMDB(t, asnPath, network, map[string]interface{}{
+		"autonomous_system_number":       uint32(20712),
+		"autonomous_system_organization": "Andrews & Arnold Ltd",
+	})
+
+	geoip, err := NewGeoIP(cityPath, asnPath)
+	if err != nil {
+		t.Fatalf("Failed to open GeoIP databases: %v", err)
+	}
+
+	// Geo fields are added before the IP is truncated
+	process := []Processor{geoip.Processor(), TruncateIP()}
+	e := Event{Key: "http_request", Data: map[string]interface{}{"client_ip": "81.2.69.160"}}
+	if !applyProcessors(process, &e) {
+		t.Fatal("Expected the event to be kept")
+	}
+
+	expected := map[string]interface{}{
+		"client_ip": "81.2.69.0",
+		"country":   "GB",
+		"region":    "England",
+		"city":      "London",
+		"asn":       uint(20712),
+		"as_org":    "Andrews & Arnold Ltd",
+	}
+	for k, v := range expected {
+		if e.Data[k] != v {
+			t.Errorf("Expected %s %v, got %v", k, v, e.Data[k])
+		}
+	}
+
+	if fields := geoip.Lookup(net.ParseIP("10.0.0.1")); len(fields) != 0 {
+		t.Errorf("Expected no fields for an unknown IP, got %v", fields)
+	}
+
+	// Unchanged files are not read again
+	if n, err := geoip.Reload(); err != nil || n != 0 {
+		t.Errorf("Expected nothing to reload, got %d, %v", n, err)
+	}
+
+	writeMMDB(t, cityPath, network, cityRecord("DE", "Berlin", "Berlin"))
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(cityPath, later, later)
+
+	if n, err := geoip.Reload(); err != nil || n != 1 {
+		t.Fatalf("Expected the city database to reload, got %d, %v", n, err)
+	}
+	if country := geoip.Lookup(net.ParseIP("81.2.69.160"))["country"]; country != "DE" {
+		t.Errorf("Expected the reloaded country DE, got %v", country)
+	}
+
+	// A broken file keeps the old data
+	os.WriteFile(cityPath, []byte("partial"), 0644)
+	if _, err := geoip.Reload(); err == nil {
+		t.Error("Expected an error for a broken database")
+	}
+	if country := geoip.Lookup(net.ParseIP("81.2.69.160"))["country"]; country != "DE" {
+		t.Errorf("Expected the old data to be kept, got %v", country)
+	}
+}
@@ -0,0 +1,270 @@
+package tlytics
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// rpcInfo is what the interceptors record about a call
+type rpcInfo struct {
+	start            time.Time
+	fullMethod       string
+	side             string
+	stream           bool
+	peer             string
+	err              error
+	messagesSent     int64
+	messagesReceived int64
+}
+
+// rpcEvent builds the rpc_request event for a finished call
+func rpcEvent(info rpcInfo) Event {
+	// Full method is /package.Service/Method
+	service, method := "", info.fullMethod
+	if i := strings.LastIndex(info.fullMethod, "/"); i >= 0 {
+		service = strings.TrimPrefix(info.fullMethod[:i], "/")
+		method = info.fullMethod[i+1:]
+	}
+
+	code := status.Code(info.err)
+
+	data := map[string]interface{}{
+		"full_method":       info.fullMethod,
+		"service":           service,
+		"method":            method,
+		"side":              info.side,
+		"stream":            info.stream,
+		"status_code":       code.String(),
+		"duration_ms":       time.Since(info.start).Milliseconds(),
+		"peer":              info.peer,
+		"messages_sent":     info.messagesSent,
+		"messages_received": info.messagesReceived,
+	}
+
+	if info.err != nil {
+		data["error"] = status.Convert(info.err).Message()
+	}
+
+	return Event{
+		Key:       "rpc_request",
+		Timestamp: info.start,
+		Data:      data,
+	}
+}
+
+func peerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// GRPCUnaryServerInterceptor emits an rpc_request event for every unary call to the server
+func GRPCUnaryServerInterceptor(analytics Emitter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+
+		resp, err := handler(ctx, req)
+
+		sent := int64(0)
+		if err == nil {
+			sent = 1
+		}
+
+		analytics.Emit(rpcEvent(rpcInfo{
+			start:            start,
+			fullMethod:       info.FullMethod,
+			side:             "server",
+			peer:             peerAddr(ctx),
+			err:              err,
+			messagesSent:     sent,
+			messagesReceived: 1,
+		}))
+
+		return resp, err
+	}
+}
+
+// countingServerStream counts the messages of a server stream
+type countingServerStream struct {
+	grpc.ServerStream
+	sent     int64
+	received int64
+}
+
+func (s *countingServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.sent++
+	}
+	return err
+}
+
+func (s *countingServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.received++
+	}
+	return err
+}
+
+// GRPCStreamServerInterceptor emits an rpc_request event for every streaming call to the server
+func GRPCStreamServerInterceptor(analytics Emitter) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		stream := &countingServerStream{ServerStream: ss}
+
+		err := handler(srv, stream)
+
+		analytics.Emit(rpcEvent(rpcInfo{
+			start:            start,
+			fullMethod:       info.FullMethod,
+			side:             "server",
+			stream:           true,
+			peer:             peerAddr(ss.Context()),
+			err:              err,
+			messagesSent:     stream.sent,
+			messagesReceived: stream.received,
+		}))
+
+		return err
+	}
+}
+
+// GRPCUnaryClientInterceptor emits an rpc_request event for every unary call made by the client
+func GRPCUnaryClientInterceptor(analytics Emitter) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+
+		var p peer.Peer
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Peer(&p))...)
+
+		addr := cc.Target()
+		if p.Addr != nil {
+			addr = p.Addr.String()
+		}
+
+		received := int64(0)
+		if err == nil {
+			received = 1
+		}
+
+		analytics.Emit(rpcEvent(rpcInfo{
+			start:            start,
+			fullMethod:       method,
+			side:             "client",
+			peer:             addr,
+			err:              err,
+			messagesSent:     1,
+			messagesReceived: received,
+		}))
+
+		return err
+	}
+}
+
+// countingClientStream counts the messages of a client stream and emits the
+// event when the stream ends
+type countingClientStream struct {
+	grpc.ClientStream
+	info          rpcInfo
+	emitter       Emitter
+	serverStreams bool // Client-streaming and unary streams end after one response
+	sent          atomic.Int64
+	received      atomic.Int64
+	once          sync.Once
+	done          chan struct{} // Closed when the event is emitted
+}
+
+func (s *countingClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.sent.Add(1)
+	} else if err != io.EOF {
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *countingClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == nil:
+		s.received.Add(1)
+		if !s.serverStreams {
+			s.finish(nil)
+		}
+	case err == io.EOF:
+		s.finish(nil)
+	default:
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *countingClientStream) finish(err error) {
+	s.once.Do(func() {
+		defer close(s.done)
+
+		info := s.info
+		info.err = err
+		if addr := peerAddr(s.ClientStream.Context()); addr != "" {
+			info.peer = addr
+		}
+		info.messagesSent = s.sent.Load()
+		info.messagesReceived = s.received.Load()
+		s.emitter.Emit(rpcEvent(info))
+	})
+}
+
+// watch emits the event when the call's context is done first, for streams
+// the caller abandons without reading them to the end
+func (s *countingClientStream) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.finish(status.FromContextError(ctx.Err()).Err())
+	case <-s.done:
+	}
+}
+
+// GRPCStreamClientInterceptor emits an rpc_request event for every streaming
+// call made by the client. The event is emitted when the stream ends, that is
+// when RecvMsg returns io.EOF or an error, or the single response of a
+// client-streaming call, or when the call's context is cancelled before.
+func GRPCStreamClientInterceptor(analytics Emitter) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		info := rpcInfo{
+			start:      time.Now(),
+			fullMethod: method,
+			side:       "client",
+			stream:     true,
+			peer:       cc.Target(),
+		}
+
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			info.err = err
+			analytics.Emit(rpcEvent(info))
+			return nil, err
+		}
+
+		stream := &countingClientStream{
+			ClientStream:  cs,
+			info:          info,
+			emitter:       analytics,
+			serverStreams: desc.ServerStreams,
+			done:          make(chan struct{}),
+		}
+		go stream.watch(ctx)
+
+		return stream, nil
+	}
+}
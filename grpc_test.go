@@ -0,0 +1,232 @@
+package tlytics
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCInterceptors(t *testing.T) {
+	serverEvents := &testEmitter{}
+	clientEvents := &testEmitter{}
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(GRPCUnaryServerInterceptor(serverEvents)),
+		grpc.StreamInterceptor(GRPCStreamServerInterceptor(serverEvents)),
+	)
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("users", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(GRPCUnaryClientInterceptor(clientEvents)),
+		grpc.WithStreamInterceptor(GRPCStreamClientInterceptor(clientEvents)),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	ctx := context.Background()
+
+	// Unary call
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "users"}); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+
+	// Failing unary call
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound, got %v", err)
+	}
+
+	// Streaming call, cancelled after the first message
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := client.Watch(streamCtx, &healthpb.HealthCheckRequest{Service: "users"})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	cancel()
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Fatalf("Expected Canceled, got %v", err)
+	}
+
+	// Give the server time to finish the stream
+	deadline := time.Now().Add(time.Second)
+	for len(serverEvents.recorded()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverRecorded, clientRecorded := serverEvents.recorded(), clientEvents.recorded()
+	if len(serverRecorded) != 3 || len(clientRecorded) != 3 {
+		t.Fatalf("Expected 3 server and 3 client events, got %d and %d", len(serverRecorded), len(clientRecorded))
+	}
+
+	for _, events := range [][]Event{serverRecorded, clientRecorded} {
+		ok := events[0].Data
+		if events[0].Key != "rpc_request" || ok["full_method"] != "/grpc.health.v1.Health/Check" || ok["status_code"] != "OK" {
+			t.Errorf("Unexpected event for successful call: %v", events[0])
+		}
+		if ok["service"] != "grpc.health.v1.Health" || ok["method"] != "Check" || ok["peer"] == "" {
+			t.Errorf("Expected service, method and peer, got %v", ok)
+		}
+
+		if events[1].Data["status_code"] != "NotFound" {
+			t.Errorf("Expected NotFound status, got %v", events[1].Data["status_code"])
+		}
+
+		watch := events[2].Data
+		if watch["method"] != "Watch" || watch["stream"] != true || watch["status_code"] != "Canceled" {
+			t.Errorf("Unexpected event for stream: %v", watch)
+		}
+	}
+
+	if serverRecorded[2].Data["messages_sent"] != int64(1) || clientRecorded[2].Data["messages_received"] != int64(1) {
+		t.Errorf("Expected 1 streamed message, got server %v and client %v",
+			serverRecorded[2].Data, clientRecorded[2].Data)
+	}
+}
+
+func TestGRPCClientStreaming(t *testing.T) {
+	serverEvents := &testEmitter{}
+	clientEvents := &testEmitter{}
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.StreamInterceptor(GRPCStreamServerInterceptor(serverEvents)))
+
+	// A client-streaming method reusing the health messages
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Upload",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Upload",
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				for {
+					var req healthpb.HealthCheckRequest
+					if err := stream.RecvMsg(&req); err == io.EOF {
+						break
+					} else if err != nil {
+						return err
+					}
+				}
+				return stream.SendMsg(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING})
+			},
+		}},
+	}, struct{}{})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStreamInterceptor(GRPCStreamClientInterceptor(clientEvents)),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := conn.NewStream(context.Background(), &grpc.StreamDesc{StreamName: "Upload", ClientStreams: true}, "/test.Upload/Upload")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.SendMsg(&healthpb.HealthCheckRequest{Service: "users"}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	// What generated CloseAndRecv methods do
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend failed: %v", err)
+	}
+	var resp healthpb.HealthCheckResponse
+	if err := stream.RecvMsg(&resp); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+
+	events := clientEvents.recorded()
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 client event, got %d", len(events))
+	}
+	data := events[0].Data
+	if data["method"] != "Upload" || data["status_code"] != "OK" || data["messages_sent"] != int64(2) || data["messages_received"] != int64(1) {
+		t.Errorf("Unexpected event for client stream: %v", data)
+	}
+}
+
+func TestGRPCClientStreamAbandoned(t *testing.T) {
+	clientEvents := &testEmitter{}
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("users", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStreamInterceptor(GRPCStreamClientInterceptor(clientEvents)),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	// Read one message, then cancel without calling Recv again
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{Service: "users"})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for len(clientEvents.recorded()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events := clientEvents.recorded()
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 client event for the abandoned stream, got %d", len(events))
+	}
+	data := events[0].Data
+	if data["status_code"] != "Canceled" || data["messages_received"] != int64(1) {
+		t.Errorf("Unexpected event for abandoned stream: %v", data)
+	}
+	if data["peer"] == "" || data["peer"] == conn.Target() {
+		t.Errorf("Expected the peer address rather than the target, got %v", data["peer"])
+	}
+}
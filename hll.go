@@ -0,0 +1,144 @@
+package tlytics
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision gives 4096 registers, a standard error of about 1.6%
+const (
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+)
+
+// Serialization formats of HyperLogLog registers
+const (
+	hllDense  = 1 // One byte per register
+	hllSparse = 2 // Index and value of the non-zero registers
+)
+
+// HyperLogLog estimates the number of distinct values added to it. Sketches
+// of the same values merge without double counting, so hourly sketches can be
+// combined into days or any other range.
+type HyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{}
+}
+
+// hllHash is FNV-1a with a final mix, so similar values spread over all
+// registers. It must not change, sketches are persisted.
+func hllHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	x := h.Sum64()
+
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add adds a value to the sketch
+func (h *HyperLogLog) Add(value string) {
+	x := hllHash(value)
+	index := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Merge adds the values of other to the sketch
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Count returns the estimated number of distinct values
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+	// Linear counting is more accurate for small cardinalities
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// MarshalBinary encodes the registers, sparsely while few are set
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	set := 0
+	for _, r := range h.registers {
+		if r != 0 {
+			set++
+		}
+	}
+
+	if set*3 >= hllRegisters {
+		return append([]byte{hllDense}, h.registers[:]...), nil
+	}
+
+	data := make([]byte, 1, 1+set*3)
+	data[0] = hllSparse
+	for i, r := range h.registers {
+		if r != 0 {
+			data = binary.BigEndian.AppendUint16(data, uint16(i))
+			data = append(data, r)
+		}
+	}
+	return data, nil
+}
+
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty HyperLogLog data")
+	}
+
+	h.registers = [hllRegisters]uint8{}
+	switch data[0] {
+	case hllDense:
+		if len(data) != 1+hllRegisters {
+			return fmt.Errorf("invalid dense HyperLogLog length: %d", len(data))
+		}
+		copy(h.registers[:], data[1:])
+	case hllSparse:
+		if (len(data)-1)%3 != 0 {
+			return fmt.Errorf("invalid sparse HyperLogLog length: %d", len(data))
+		}
+		for i := 1; i < len(data); i += 3 {
+			index := binary.BigEndian.Uint16(data[i:])
+			if int(index) >= hllRegisters {
+				return fmt.Errorf("invalid HyperLogLog register: %d", index)
+			}
+			h.registers[index] = data[i+2]
+		}
+	default:
+		return fmt.Errorf("unknown HyperLogLog format: %d", data[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package tlytics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// HotFieldStore is implemented by stores that can keep often filtered data
+// fields in indexed columns. Queries and aggregations of a key filtering or
+// grouping by one of its hot fields then read the column instead of parsing
+// the JSON of each row.
+type HotFieldStore interface {
+	// SetHotFields adds the columns of the data fields and an index per event
+	// key covering only the events of that key. Call it before using the store.
+	SetHotFields(fields map[string][]string) error
+}
+
+// hotFieldPattern limits hot fields to names usable in column names unquoted
+var hotFieldPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// hotFields maps event keys to their hot data fields
+type hotFields map[string]map[string]bool
+
+// has reports whether the field is hot for the key
+func (h hotFields) has(key, field string) bool {
+	return h[key][field]
+}
+
+// columns returns the fields hot for any key in a stable order, each has one
+// column shared by the keys
+func (h hotFields) columns() []string {
+	set := make(map[string]bool)
+	for _, fields := range h {
+		for field := range fields {
+			set[field] = true
+		}
+	}
+
+	columns := make([]string, 0, len(set))
+	for field := range set {
+		columns = append(columns, field)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// keys returns the keys the field is hot for in a stable order
+func (h hotFields) keys(field string) []string {
+	var keys []string
+	for key, fields := range h {
+		if fields[field] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hotFieldSet validates the hot fields. Column names are case-insensitive,
+// so fields differing only in case are rejected.
+func hotFieldSet(fields map[string][]string) (hotFields, error) {
+	hot := make(hotFields)
+	folded := make(map[string]string)
+	for key, keyFields := range fields {
+		for _, field := range keyFields {
+			if !hotFieldPattern.MatchString(field) {
+				return nil, fmt.Errorf("invalid hot field %q of key %q: only letters, digits and underscores are allowed", field, key)
+			}
+			if other, ok := folded[strings.ToLower(field)]; ok && other != field {
+				return nil, fmt.Errorf("hot fields %q and %q differ only in case", other, field)
+			}
+			folded[strings.ToLower(field)] = field
+			if hot[key] == nil {
+				hot[key] = make(map[string]bool)
+			}
+			hot[key][field] = true
+		}
+	}
+	return hot, nil
+}
+
+// hotColumn returns the column holding a hot field
+func hotColumn(field string) string {
+	return "hot_" + field
+}
+
+// hotIndex returns the statement creating the index of a hot field covering
+// the events of the key. Keys may hold any text, so the name uses a hash of it.
+func hotIndex(field, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	column := hotColumn(field)
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS tlytics_%s_%s_idx ON tlytics (%s, timestamp) WHERE key = '%s'",
+		column, hex.EncodeToString(hash[:4]), column, strings.ReplaceAll(key, "'", "''"))
+}
@@ -0,0 +1,117 @@
+package tlytics
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHotFields(t *testing.T) {
+	hot := map[string][]string{"request": {"path", "status_code"}}
+	events := breakdownTestEvents()
+
+	for name, store := range testStores(t) {
+		hotStore, ok := store.(HotFieldStore)
+		if !ok {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			// Events stored before the columns exist are covered too
+			if err := store.InsertEvents(events[:4]); err != nil {
+				t.Fatalf("Failed to insert events: %v", err)
+			}
+			if err := hotStore.SetHotFields(hot); err != nil {
+				t.Fatalf("Failed to set hot fields: %v", err)
+			}
+			// Setting them again keeps the existing columns
+			if err := hotStore.SetHotFields(hot); err != nil {
+				t.Fatalf("Failed to set hot fields again: %v", err)
+			}
+			if err := store.InsertEvents(events[4:]); err != nil {
+				t.Fatalf("Failed to insert events: %v", err)
+			}
+
+			count, err := store.CountEvents(Query{Key: "request", Field: "status_code", Value: "500"})
+			if err != nil {
+				t.Fatalf("Failed to count events: %v", err)
+			}
+			if count != 2 {
+				t.Errorf("Expected 2 events with status 500, got %d", count)
+			}
+
+			found, err := store.QueryEvents(Query{Field: "path", Value: "/"})
+			if err != nil {
+				t.Fatalf("Failed to query events: %v", err)
+			}
+			if len(found) != 4 {
+				t.Errorf("Expected 4 events of path /, got %d", len(found))
+			}
+
+			groups, err := store.Breakdown(Query{Key: "request", Field: "path", Value: "/api/users"}, Breakdown{Fields: []string{"status_code"}})
+			if err != nil {
+				t.Fatalf("Failed to break down events: %v", err)
+			}
+			expected := []BreakdownGroup{
+				{Values: []string{"500"}, Count: 2},
+				{Values: []string{"200"}, Count: 1},
+			}
+			if !reflect.DeepEqual(groups, expected) {
+				t.Errorf("Expected %+v, got %+v", expected, groups)
+			}
+
+			if err := hotStore.SetHotFields(map[string][]string{"request": {"path; DROP TABLE tlytics"}}); err == nil {
+				t.Error("Expected an error for an invalid field name")
+			}
+			if err := hotStore.SetHotFields(map[string][]string{"request": {"path"}, "view": {"Path"}}); err == nil {
+				t.Error("Expected an error for fields differing only in case")
+			}
+			if err := hotStore.SetHotFields(map[string][]string{"request": {"Path"}}); err == nil {
+				t.Error("Expected an error for a field differing only in case from an existing column")
+			}
+		})
+	}
+}
+
+func TestHotFieldsUseIndex(t *testing.T) {
+	db, err := Init(":memory:")
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.SetHotFields(map[string][]string{"request": {"path"}, "it's": {"path"}}); err != nil {
+		t.Fatalf("Failed to set hot fields: %v", err)
+	}
+
+	plan := func(q Query) string {
+		where, args := db.whereClause(q)
+		rows, err := db.reader.Query("EXPLAIN QUERY PLAN SELECT COUNT(*) FROM tlytics"+where, args...)
+		if err != nil {
+			t.Fatalf("Failed to explain query: %v", err)
+		}
+		defer rows.Close()
+
+		var details []string
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+			if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+				t.Fatalf("Failed to read plan: %v", err)
+			}
+			details = append(details, detail)
+		}
+		return strings.Join(details, "\n")
+	}
+
+	for _, key := range []string{"request", "it's"} {
+		if p := plan(Query{Key: key, Field: "path", Value: "/"}); !strings.Contains(p, "tlytics_hot_path_") {
+			t.Errorf("Expected the query of key %q to use its hot field index, got plan %v", key, p)
+		}
+	}
+
+	// The field is not hot for other keys
+	if p := plan(Query{Key: "page_view", Field: "path", Value: "/"}); strings.Contains(p, "tlytics_hot_path_") {
+		t.Errorf("Expected the query of another key not to use the hot field index, got plan %v", p)
+	}
+}
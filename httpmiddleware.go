@@ -0,0 +1,149 @@
+package tlytics
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// responseRecorder captures the status and size of the response written by a handler
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (w *responseRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+// Hijack lets websocket and other upgrade handlers take over the connection
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// HTTPMiddleware emits the same http_request events as GinMiddleware for
+// handlers using the standard net/http package.
+//
+// The route is the pattern matched by an http.ServeMux when it wraps one,
+// otherwise opts.RouteFunc or the raw path.
+func HTTPMiddleware(analytics Emitter, opts MiddlewareOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		route := opts.RouteFunc
+		if route == nil {
+			route = func(r *http.Request) string {
+				if mux, ok := next.(*http.ServeMux); ok {
+					_, pattern := mux.Handler(r)
+					return pattern
+				}
+				return r.URL.Path
+			}
+		}
+
+		return httpMiddleware(analytics, opts, next, route)
+	}
+}
+
+// httpMiddleware records requests to next. route is called after the handler,
+// so routers can resolve the route template while serving the request.
+func httpMiddleware(analytics Emitter, opts MiddlewareOptions, next http.Handler, route func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if opts.skip(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+
+		emit := func(status int, panicked bool) {
+			routeTemplate := route(r)
+			if routeTemplate == "" {
+				routeTemplate = UnmatchedRoute
+			}
+
+			if !opts.sampled(routeTemplate) {
+				return
+			}
+
+			analytics.Emit(opts.requestEvent(requestInfo{
+				start:          start,
+				request:        r,
+				responseHeader: recorder.Header(),
+				route:          routeTemplate,
+				status:         status,
+				size:           recorder.size,
+				clientIP:       opts.clientIP(r),
+				panicked:       panicked,
+			}))
+		}
+
+		defer func() {
+			if err := recover(); err != nil {
+				emit(http.StatusInternalServerError, true)
+				panic(err)
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+
+		emit(recorder.statusCode(), false)
+	})
+}
+
+// clientIP returns the client IP from ClientIPHeader or the remote address
+func (o MiddlewareOptions) clientIP(r *http.Request) string {
+	if o.ClientIPHeader != "" {
+		if ip := r.Header.Get(o.ClientIPHeader); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,157 @@
+package tlytics
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// checkRequestEvents checks the events of the requests to /users/1 and /missing
+func checkRequestEvents(t *testing.T, events []Event, route string) {
+	t.Helper()
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+
+	data := events[0].Data
+	if events[0].Key != "http_request" || data["route"] != route || data["path"] != "/users/1" {
+		t.Errorf("Expected http_request event for route %s, got %v", route, events[0])
+	}
+	if data["status_code"] != http.StatusCreated || data["response_size"] != 2 || data["method"] != "GET" {
+		t.Errorf("Expected status 201 and size 2, got %v", data)
+	}
+	if data["client_ip"] != "192.0.2.1" {
+		t.Errorf("Expected client IP 192.0.2.1, got %v", data["client_ip"])
+	}
+	if data["service"] != "users-api" {
+		t.Errorf("Expected static service field, got %v", data["service"])
+	}
+
+	if events[1].Data["route"] != UnmatchedRoute || events[1].Data["status_code"] != http.StatusNotFound {
+		t.Errorf("Expected unmatched 404 event, got %v", events[1].Data)
+	}
+}
+
+var testMiddlewareOptions = MiddlewareOptions{
+	SkipPaths:    []string{"/health"},
+	StaticFields: map[string]interface{}{"service": "users-api"},
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	emitter := &testEmitter{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+
+	handler := HTTPMiddleware(emitter, testMiddlewareOptions)(mux)
+
+	for _, target := range []string{"/users/1", "/missing", "/health"} {
+		serveTestRequest(handler, "GET", target)
+	}
+
+	checkRequestEvents(t, emitter.events, "GET /users/{id}")
+}
+
+func TestChiMiddleware(t *testing.T) {
+	emitter := &testEmitter{}
+
+	r := chi.NewRouter()
+	r.Use(ChiMiddleware(emitter, testMiddlewareOptions))
+	r.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("ok"))
+	})
+
+	for _, target := range []string{"/users/1", "/missing", "/health"} {
+		serveTestRequest(r, "GET", target)
+	}
+
+	checkRequestEvents(t, emitter.events, "/users/{id}")
+}
+
+func TestEchoMiddleware(t *testing.T) {
+	emitter := &testEmitter{}
+
+	e := echo.New()
+	e.Use(EchoMiddleware(emitter, testMiddlewareOptions))
+	e.GET("/users/:id", func(c echo.Context) error {
+		return c.String(http.StatusCreated, "ok")
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid id")
+	})
+	e.GET("/error", func(c echo.Context) error {
+		return errors.New("database down")
+	})
+
+	for _, target := range []string{"/users/1", "/missing", "/health"} {
+		serveTestRequest(e, "GET", target)
+	}
+
+	checkRequestEvents(t, emitter.events, "/users/:id")
+
+	serveTestRequest(e, "GET", "/fail")
+	serveTestRequest(e, "GET", "/error")
+
+	if emitter.events[2].Data["status_code"] != http.StatusBadRequest {
+		t.Errorf("Expected status 400 from HTTPError, got %v", emitter.events[2].Data["status_code"])
+	}
+	errs, _ := emitter.events[3].Data["errors"].([]string)
+	if emitter.events[3].Data["status_code"] != http.StatusInternalServerError || len(errs) != 1 || errs[0] != "database down" {
+		t.Errorf("Expected status 500 with the handler error, got %v", emitter.events[3].Data)
+	}
+}
+
+func TestHTTPMiddlewareHijack(t *testing.T) {
+	emitter := &testEmitter{}
+
+	handler := HTTPMiddleware(emitter, MiddlewareOptions{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Failed to hijack the connection: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		rw.Flush()
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(status, "HTTP/1.1 101") {
+		t.Fatalf("Expected 101 Switching Protocols, got %q (%v)", status, err)
+	}
+
+	// The event is emitted once the handler returns
+	deadline := time.Now().Add(time.Second)
+	for len(emitter.recorded()) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events := emitter.recorded()
+	if len(events) != 1 || events[0].Data["status_code"] != http.StatusSwitchingProtocols {
+		t.Errorf("Expected an event with status 101, got %v", events)
+	}
+}
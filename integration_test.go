@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -94,7 +95,7 @@ func TestClientServerIntegration(t *testing.T) {
 	time.Sleep(200 * time.Millisecond)
 
 	// Verify events were stored in the server database
-	events, total, err := server.db.GetEvents(10, 0)
+	events, total, err := server.store.GetEvents(10, 0)
 	if err != nil {
 		t.Fatalf("Failed to retrieve events from server: %v", err)
 	}
@@ -243,7 +244,7 @@ func TestMultipleEventsIntegration(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	// Verify all events were stored
-	events, total, err := server.db.GetEvents(10, 0)
+	events, total, err := server.store.GetEvents(10, 0)
 	if err != nil {
 		t.Fatalf("Failed to retrieve events from server: %v", err)
 	}
@@ -275,4 +276,29 @@ func TestMultipleEventsIntegration(t *testing.T) {
 			t.Errorf("Event %s not found in stored events", expectedKey)
 		}
 	}
-}
\ No newline at end of file
+}
+func TestNewServerLeavesProvidedStoreOpen(t *testing.T) {
+	db, err := Init(filepath.Join(t.TempDir(), "analytics.sqlite"))
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	// The wrapper hides the optional interfaces, so the config is rejected
+	store := struct{ Store }{db}
+	configs := []ServerConfig{
+		{Store: store, DistinctFields: map[string][]string{"view": {"user_id"}}},
+		{Store: store, HotFields: map[string][]string{"view": {"user_id"}}},
+		{Store: store, BackupDir: t.TempDir()},
+		{Store: store, ErasureSecret: "secret"},
+	}
+	for _, config := range configs {
+		if _, err := NewServer(config); err == nil {
+			t.Fatalf("Expected %+v to be rejected", config)
+		}
+	}
+
+	if err := db.InsertEvents([]Event{{Key: "view", Timestamp: time.Now()}}); err != nil {
+		t.Errorf("Expected the store to be left open, got %v", err)
+	}
+}
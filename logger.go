@@ -1,12 +1,16 @@
 package tlytics
 
 import (
+	"context"
 	"sync"
 	"time"
 )
 
 type Logger struct {
-	db          *DB
+	store       Store
+	processors  []Processor
+	rawPII      []string
+	distinct    map[string][]string
 	queue       []Event
 	flushPeriod time.Duration
 	mutex       sync.RWMutex
@@ -14,9 +18,12 @@ type Logger struct {
 	wg          sync.WaitGroup
 }
 
-func NewLogger(db *DB, flushPeriod time.Duration) *Logger {
+// NewLogger creates a logger writing to the store. The processors run on
+// every event before it is queued.
+func NewLogger(store Store, flushPeriod time.Duration, processors ...Processor) *Logger {
 	logger := &Logger{
-		db:          db,
+		store:       store,
+		processors:  processors,
 		queue:       make([]Event, 0),
 		flushPeriod: flushPeriod,
 		stopCh:      make(chan struct{}),
@@ -33,6 +40,10 @@ func (l *Logger) Emit(e Event) error {
 		e.Timestamp = time.Now()
 	}
 	
+	if ok, err := processEvent(l.processors, l.rawPII, &e); !ok {
+		return err
+	}
+	
 	l.mutex.Lock()
 	l.queue = append(l.queue, e)
 	l.mutex.Unlock()
@@ -40,6 +51,21 @@ func (l *Logger) Emit(e Event) error {
 	return nil
 }
 
+// EmitContext queues the event with the properties attached to the context
+func (l *Logger) EmitContext(ctx context.Context, e Event) error {
+	return l.Emit(enrich(ctx, e))
+}
+
+// checkPolicy returns an error if the event would be rejected by Emit
+func (l *Logger) checkPolicy(e Event) error {
+	if len(l.rawPII) == 0 {
+		return nil
+	}
+	
+	_, err := processEvent(l.processors, l.rawPII, &e)
+	return err
+}
+
 func (l *Logger) flushWorker() {
 	defer l.wg.Done()
 	
@@ -69,11 +95,19 @@ func (l *Logger) flush() {
 	l.queue = l.queue[:0] // Clear the queue
 	l.mutex.Unlock()
 	
-	// Insert events to database
-	if err := l.db.InsertEvents(events); err != nil {
+	// Insert events to the store
+	if err := l.store.InsertEvents(events); err != nil {
 		// In a production system, you might want to log this error
 		// or implement a retry mechanism
 		_ = err
+		return
+	}
+	
+	// Update the distinct count sketches of the configured fields
+	if sketches, ok := l.store.(SketchStore); ok && len(l.distinct) > 0 {
+		if err := sketches.MergeSketches(buildSketches(events, l.distinct)); err != nil {
+			_ = err
+		}
 	}
 }
 
@@ -0,0 +1,226 @@
+package tlytics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps events in memory. Useful for tests and ephemeral deployments.
+type MemoryStore struct {
+	events   []Event
+	sketches map[sketchID]*HyperLogLog
+	erasures []ErasureRecord
+	mutex    sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		events:   make([]Event, 0),
+		sketches: make(map[sketchID]*HyperLogLog),
+	}
+}
+
+func (m *MemoryStore) InsertEvents(events []Event) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, event := range events {
+		event.Timestamp = event.Timestamp.UTC()
+		m.events = append(m.events, event)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) GetEvents(limit, offset int) ([]Event, int, error) {
+	events, err := m.QueryEvents(Query{Limit: limit, Offset: offset})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := m.CountEvents(Query{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
+
+func (m *MemoryStore) QueryEvents(q Query) ([]Event, error) {
+	m.mutex.RLock()
+	var events []Event
+	for _, event := range m.events {
+		if q.matches(event) {
+			events = append(events, event)
+		}
+	}
+	m.mutex.RUnlock()
+
+	// Newest first, same as the SQL stores
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.After(events[j].Timestamp)
+	})
+
+	if q.Offset > 0 {
+		if q.Offset >= len(events) {
+			return nil, nil
+		}
+		events = events[q.Offset:]
+	}
+
+	if q.Limit > 0 && q.Limit < len(events) {
+		events = events[:q.Limit]
+	}
+
+	return events, nil
+}
+
+func (m *MemoryStore) CountEvents(q Query) (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	count := 0
+	for _, event := range m.events {
+		if q.matches(event) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (m *MemoryStore) Aggregate(q Query, interval time.Duration) ([]AggregateBucket, error) {
+	if interval < time.Second {
+		return nil, fmt.Errorf("aggregate interval must be at least 1s, got %s", interval)
+	}
+
+	type bucketID struct {
+		key   string
+		start int64
+	}
+
+	seconds := int64(interval / time.Second)
+	counts := make(map[bucketID]int)
+
+	m.mutex.RLock()
+	for _, event := range m.events {
+		if !q.matches(event) {
+			continue
+		}
+		start := event.Timestamp.Unix() / seconds * seconds
+		counts[bucketID{key: event.Key, start: start}]++
+	}
+	m.mutex.RUnlock()
+
+	buckets := make([]AggregateBucket, 0, len(counts))
+	for id, count := range counts {
+		buckets = append(buckets, AggregateBucket{
+			Key:   id.key,
+			Start: time.Unix(id.start, 0).UTC(),
+			Count: count,
+		})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		if !buckets[i].Start.Equal(buckets[j].Start) {
+			return buckets[i].Start.Before(buckets[j].Start)
+		}
+		return buckets[i].Key < buckets[j].Key
+	})
+
+	return buckets, nil
+}
+
+// Breakdown groups the events matching the query, at most Limit groups are
+// returned. Offset is ignored.
+func (m *MemoryStore) Breakdown(q Query, b Breakdown) ([]BreakdownGroup, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	m.mutex.RLock()
+	var events []Event
+	for _, event := range m.events {
+		if q.matches(event) {
+			events = append(events, event)
+		}
+	}
+	m.mutex.RUnlock()
+
+	return sortBreakdown(breakdownEvents(events, b), b, q.Limit), nil
+}
+
+// DeleteEvents removes the events matching the query filters, at most Limit
+// if set. Offset is ignored.
+func (m *MemoryStore) DeleteEvents(q Query) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	kept := m.events[:0]
+	var deleted int64
+	for _, event := range m.events {
+		if q.matches(event) && (q.Limit <= 0 || deleted < int64(q.Limit)) {
+			deleted++
+			continue
+		}
+		kept = append(kept, event)
+	}
+	m.events = kept
+
+	return deleted, nil
+}
+
+func (m *MemoryStore) MergeSketches(sketches []Sketch) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mergeSketchMap(m.sketches, sketches)
+	return nil
+}
+
+func (m *MemoryStore) QuerySketches(q Query, field string) ([]Sketch, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var sketches []Sketch
+	for id, hll := range m.sketches {
+		start := time.Unix(id.start, 0).UTC()
+		if id.field != field || q.Key != "" && id.key != q.Key {
+			continue
+		}
+		if !q.From.IsZero() && start.Before(q.From) || !q.To.IsZero() && !start.Before(q.To) {
+			continue
+		}
+
+		copied := NewHyperLogLog()
+		copied.Merge(hll)
+		sketches = append(sketches, Sketch{Key: id.key, Field: id.field, Start: start, HLL: copied})
+	}
+
+	return sketches, nil
+}
+
+func (m *MemoryStore) InsertErasure(record ErasureRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.erasures = append(m.erasures, record)
+	return nil
+}
+
+func (m *MemoryStore) Erasures() ([]ErasureRecord, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	records := make([]ErasureRecord, 0, len(m.erasures))
+	for i := len(m.erasures) - 1; i >= 0; i-- {
+		records = append(records, m.erasures[i])
+	}
+	return records, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
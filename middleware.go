@@ -1,60 +1,301 @@
 package tlytics
 
 import (
+	"math/rand"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// UnmatchedRoute is recorded as the route of requests that matched no route (404s)
+const UnmatchedRoute = "<unmatched>"
+
+// MiddlewareOptions configures the request tracking middleware
+type MiddlewareOptions struct {
+	OmitRawPath bool   // Don't record the raw request path, only the route template
+	EventKey    string // Event key, "http_request" if empty
+
+	// Paths not recorded at all. An entry ending in "*" is a prefix, e.g. "/static/*".
+	SkipPaths []string
+
+	// Fraction of requests recorded, 0 records all. RouteSampleRates
+	// overrides it per route template, where 0 records none.
+	SampleRate       float64
+	RouteSampleRates map[string]float64
+
+	RequestHeaders  []string // Request headers recorded in request_headers
+	ResponseHeaders []string // Response headers recorded in response_headers
+	QueryParams     []string // Query parameters recorded in query
+
+	StaticFields map[string]interface{} // Added to every event, e.g. service name
+
+	// Route template of a request for HTTPMiddleware when it doesn't wrap an
+	// http.ServeMux. Not used by the Gin, chi and echo middlewares.
+	RouteFunc func(r *http.Request) string
+
+	// Header with the request ID read by GinMiddleware, X-Request-ID if empty
+	RequestIDHeader string
+
+	// Header with the client IP set by a trusted proxy, e.g. X-Real-IP, for the
+	// net/http, chi and echo middlewares. The remote address is used if empty.
+	ClientIPHeader string
+}
+
+func (o MiddlewareOptions) requestIDHeader() string {
+	if o.RequestIDHeader == "" {
+		return RequestIDHeader
+	}
+	return o.RequestIDHeader
+}
+
+func (o MiddlewareOptions) eventKey() string {
+	if o.EventKey == "" {
+		return "http_request"
+	}
+	return o.EventKey
+}
+
+// skip reports whether the path is in SkipPaths
+func (o MiddlewareOptions) skip(path string) bool {
+	for _, skipPath := range o.SkipPaths {
+		if prefix, ok := strings.CutSuffix(skipPath, "*"); ok {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == skipPath {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled decides whether a request to the route is recorded
+func (o MiddlewareOptions) sampled(route string) bool {
+	rate := o.SampleRate
+	if routeRate, ok := o.RouteSampleRates[route]; ok {
+		rate = routeRate
+	} else if rate == 0 {
+		return true
+	}
+	
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// requestInfo is what the middlewares record about a request
+type requestInfo struct {
+	start          time.Time
+	request        *http.Request
+	responseHeader http.Header
+	route          string
+	status         int
+	size           int
+	clientIP       string
+	errors         []string
+	panicked       bool
+	correlation    Correlation
+}
+
+// requestEvent builds the http_request event, the same for every framework
+func (o MiddlewareOptions) requestEvent(info requestInfo) Event {
+	r := info.request
+	data := map[string]interface{}{
+		"method":        r.Method,
+		"route":         info.route,
+		"status_code":   info.status,
+		"duration_ms":   time.Since(info.start).Milliseconds(),
+		"client_ip":     info.clientIP,
+		"user_agent":    r.Header.Get("User-Agent"),
+		"response_size": info.size,
+	}
+	
+	if !o.OmitRawPath {
+		data["path"] = r.URL.Path
+	}
+	
+	if len(info.errors) > 0 {
+		data["errors"] = info.errors
+	}
+	
+	if info.panicked {
+		data["panic"] = true
+	}
+	
+	info.correlation.addTo(data)
+	
+	for k, v := range o.StaticFields {
+		data[k] = v
+	}
+	
+	if headers := pickHeaders(r.Header, o.RequestHeaders); len(headers) > 0 {
+		data["request_headers"] = headers
+	}
+	
+	if headers := pickHeaders(info.responseHeader, o.ResponseHeaders); len(headers) > 0 {
+		data["response_headers"] = headers
+	}
+	
+	if len(o.QueryParams) > 0 {
+		query := r.URL.Query()
+		params := make(map[string]interface{})
+		for _, name := range o.QueryParams {
+			if query.Has(name) {
+				params[name] = query.Get(name)
+			}
+		}
+		if len(params) > 0 {
+			data["query"] = params
+		}
+	}
+	
+	return Event{
+		Key:       o.eventKey(),
+		Timestamp: info.start,
+		Data:      data,
+	}
+}
+
+func pickHeaders(header http.Header, names []string) map[string]interface{} {
+	picked := make(map[string]interface{})
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			picked[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return picked
+}
+
+// GinMiddleware emits an http_request event for every request
 func GinMiddleware(analytics Emitter) gin.HandlerFunc {
+	return GinMiddlewareWithOptions(analytics, MiddlewareOptions{})
+}
+
+// GinMiddlewareWithOptions is GinMiddleware with options
+func GinMiddlewareWithOptions(analytics Emitter, opts MiddlewareOptions) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
 		
+		// Correlation IDs for every request, also the ones not recorded
+		header := opts.requestIDHeader()
+		corr := correlationFromRequest(c.Request, header)
+		c.Set(correlationKey, corr)
+		c.Header(header, corr.RequestID)
+		
+		// So events emitted with EmitContext(c.Request.Context(), ...) are correlated too
+		correlationData := make(map[string]interface{}, 3)
+		corr.addTo(correlationData)
+		c.Request = c.Request.WithContext(WithProperties(c.Request.Context(), correlationData))
+		
+		// Route template like /users/:id, so requests can be grouped per endpoint
+		route := c.FullPath()
+		if route == "" {
+			route = UnmatchedRoute
+		}
+		
+		if opts.skip(c.Request.URL.Path) || !opts.sampled(route) {
+			c.Next()
+			return
+		}
+		
+		// emit logs the request event. A panic in a handler is recorded as a 500
+		// before it continues to the recovery middleware.
+		emit := func(status int, panicked bool) {
+			info := requestInfo{
+				start:          start,
+				request:        c.Request,
+				responseHeader: c.Writer.Header(),
+				route:          route,
+				status:         status,
+				size:           c.Writer.Size(),
+				clientIP:       c.ClientIP(),
+				panicked:       panicked,
+				correlation:    corr,
+			}
+			
+			if len(c.Errors) > 0 {
+				info.errors = c.Errors.Errors()
+			}
+			
+			analytics.Emit(opts.requestEvent(info))
+		}
+		
+		defer func() {
+			if err := recover(); err != nil {
+				recordPanicStack(c)
+				emit(http.StatusInternalServerError, true)
+				panic(err)
+			}
+		}()
+		
 		// Process request
 		c.Next()
 		
-		// Log the request event
-		event := Event{
-			Key:       "http_request",
-			Timestamp: start,
-			Data: map[string]interface{}{
-				"method":        c.Request.Method,
-				"path":          c.Request.URL.Path,
-				"status_code":   c.Writer.Status(),
-				"duration_ms":   time.Since(start).Milliseconds(),
-				"client_ip":     c.ClientIP(),
-				"user_agent":    c.GetHeader("User-Agent"),
-				"response_size": c.Writer.Size(),
-			},
+		emit(c.Writer.Status(), false)
+	}
+}
+
+// DataExtractor returns fields to add to an event from the request.
+// Extractors run after the handler, so they can read values it set on the context.
+type DataExtractor func(c *gin.Context) map[string]interface{}
+
+// RouteParams adds the route parameters as param_<name> fields
+func RouteParams() DataExtractor {
+	return func(c *gin.Context) map[string]interface{} {
+		data := make(map[string]interface{}, len(c.Params))
+		for _, param := range c.Params {
+			data["param_"+param.Key] = param.Value
 		}
-		
-		analytics.Emit(event)
+		return data
 	}
 }
 
-func TrackEvent(analytics Emitter, key string, data map[string]interface{}) gin.HandlerFunc {
+// ContextValues adds the values stored on the gin.Context under the keys, e.g. a user ID set by auth middleware
+func ContextValues(keys ...string) DataExtractor {
+	return func(c *gin.Context) map[string]interface{} {
+		data := make(map[string]interface{}, len(keys))
+		for _, key := range keys {
+			if value, ok := c.Get(key); ok {
+				data[key] = value
+			}
+		}
+		return data
+	}
+}
+
+// TrackEvent emits an event with the static data and the fields from the extractors for every request
+func TrackEvent(analytics Emitter, key string, data map[string]interface{}, extractors ...DataExtractor) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
 		
 		// Process request first
 		c.Next()
 		
-		// Create event with duration
-		event := Event{
-			Key:       key,
-			Timestamp: start,
-			Data:      data,
+		// Copy the static data, the map is shared by all requests
+		eventData := make(map[string]interface{}, len(data)+3)
+		for k, v := range data {
+			eventData[k] = v
 		}
 		
-		if event.Data == nil {
-			event.Data = make(map[string]interface{})
+		for _, extract := range extractors {
+			for k, v := range extract(c) {
+				eventData[k] = v
+			}
+		}
+		
+		if corr, ok := GetCorrelation(c); ok {
+			corr.addTo(eventData)
 		}
 		
 		// Add request context and duration to the event data
-		event.Data["request_path"] = c.Request.URL.Path
-		event.Data["client_ip"] = c.ClientIP()
-		event.Data["duration_ms"] = time.Since(start).Milliseconds()
+		eventData["request_path"] = c.Request.URL.Path
+		eventData["client_ip"] = c.ClientIP()
+		eventData["duration_ms"] = time.Since(start).Milliseconds()
 		
-		analytics.Emit(event)
+		analytics.Emit(Event{
+			Key:       key,
+			Timestamp: start,
+			Data:      eventData,
+		})
 	}
 }
\ No newline at end of file
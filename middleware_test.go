@@ -0,0 +1,332 @@
+package tlytics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testEmitter collects emitted events
+type testEmitter struct {
+	events []Event
+	mutex  sync.Mutex
+}
+
+func (e *testEmitter) Emit(event Event) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.events = append(e.events, event)
+	return nil
+}
+
+// recorded returns a copy of the events emitted so far
+func (e *testEmitter) recorded() []Event {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]Event(nil), e.events...)
+}
+
+func newTestRouter(middleware ...gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware...)
+	r.GET("/users/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	return r
+}
+
+func serveTestRequest(r http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestGinMiddlewareRouteTemplate(t *testing.T) {
+	emitter := &testEmitter{}
+	r := newTestRouter(GinMiddleware(emitter))
+
+	serveTestRequest(r, "GET", "/users/123")
+	serveTestRequest(r, "GET", "/users/456")
+	serveTestRequest(r, "GET", "/missing")
+
+	if len(emitter.events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(emitter.events))
+	}
+
+	for i, path := range []string{"/users/123", "/users/456"} {
+		data := emitter.events[i].Data
+		if data["route"] != "/users/:id" {
+			t.Errorf("Expected route /users/:id, got %v", data["route"])
+		}
+		if data["path"] != path {
+			t.Errorf("Expected path %s, got %v", path, data["path"])
+		}
+	}
+
+	data := emitter.events[2].Data
+	if data["route"] != UnmatchedRoute {
+		t.Errorf("Expected unmatched route, got %v", data["route"])
+	}
+	if data["status_code"] != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %v", data["status_code"])
+	}
+}
+
+func TestGinMiddlewareOmitRawPath(t *testing.T) {
+	emitter := &testEmitter{}
+	r := newTestRouter(GinMiddlewareWithOptions(emitter, MiddlewareOptions{OmitRawPath: true}))
+
+	serveTestRequest(r, "GET", "/users/123")
+
+	if len(emitter.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(emitter.events))
+	}
+	if _, ok := emitter.events[0].Data["path"]; ok {
+		t.Error("Expected no raw path in the event")
+	}
+	if emitter.events[0].Data["route"] != "/users/:id" {
+		t.Errorf("Expected route /users/:id, got %v", emitter.events[0].Data["route"])
+	}
+}
+
+func TestTrackEventCopiesDataAndExtracts(t *testing.T) {
+	emitter := &testEmitter{}
+	static := map[string]interface{}{"endpoint": "users"}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/users/:id",
+		func(c *gin.Context) {
+			c.Set("user_id", "u-"+c.Param("id"))
+		},
+		TrackEvent(emitter, "api_access", static, RouteParams(), ContextValues("user_id", "tenant")),
+		func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+
+	serveTestRequest(r, "GET", "/users/1")
+	serveTestRequest(r, "GET", "/users/2")
+
+	if len(static) != 1 {
+		t.Errorf("Expected the static data map to be unchanged, got %v", static)
+	}
+
+	if len(emitter.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(emitter.events))
+	}
+
+	for i, id := range []string{"1", "2"} {
+		data := emitter.events[i].Data
+		if data["endpoint"] != "users" {
+			t.Errorf("Expected static endpoint field, got %v", data["endpoint"])
+		}
+		if data["param_id"] != id {
+			t.Errorf("Expected param_id %s, got %v", id, data["param_id"])
+		}
+		if data["user_id"] != "u-"+id {
+			t.Errorf("Expected user_id u-%s, got %v", id, data["user_id"])
+		}
+		if _, ok := data["tenant"]; ok {
+			t.Error("Expected no tenant field when it is not set on the context")
+		}
+	}
+}
+
+func TestGinMiddlewareOptions(t *testing.T) {
+	emitter := &testEmitter{}
+	r := newTestRouter(GinMiddlewareWithOptions(emitter, MiddlewareOptions{
+		EventKey:         "api_request",
+		SkipPaths:        []string{"/health", "/static/*"},
+		RouteSampleRates: map[string]float64{UnmatchedRoute: 0},
+		RequestHeaders:   []string{"x-tenant"},
+		ResponseHeaders:  []string{"Content-Type"},
+		QueryParams:      []string{"page", "missing"},
+		StaticFields:     map[string]interface{}{"service": "users-api"},
+	}))
+	r.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/static/app.js", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	serveTestRequest(r, "GET", "/health")
+	serveTestRequest(r, "GET", "/static/app.js")
+	serveTestRequest(r, "GET", "/not-found")
+
+	if len(emitter.events) != 0 {
+		t.Fatalf("Expected skipped and unsampled requests to emit nothing, got %v", emitter.events)
+	}
+
+	req := httptest.NewRequest("GET", "/users/1?page=2&secret=x", nil)
+	req.Header.Set("X-Tenant", "acme")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(emitter.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(emitter.events))
+	}
+
+	event := emitter.events[0]
+	if event.Key != "api_request" {
+		t.Errorf("Expected key api_request, got %s", event.Key)
+	}
+	if event.Data["service"] != "users-api" {
+		t.Errorf("Expected static service field, got %v", event.Data["service"])
+	}
+
+	requestHeaders, _ := event.Data["request_headers"].(map[string]interface{})
+	if requestHeaders["X-Tenant"] != "acme" {
+		t.Errorf("Expected X-Tenant request header, got %v", event.Data["request_headers"])
+	}
+
+	responseHeaders, _ := event.Data["response_headers"].(map[string]interface{})
+	if responseHeaders["Content-Type"] == nil {
+		t.Errorf("Expected Content-Type response header, got %v", event.Data["response_headers"])
+	}
+
+	query, _ := event.Data["query"].(map[string]interface{})
+	if len(query) != 1 || query["page"] != "2" {
+		t.Errorf("Expected only the page query parameter, got %v", event.Data["query"])
+	}
+}
+
+func TestMiddlewareSampleRate(t *testing.T) {
+	opts := MiddlewareOptions{SampleRate: 0.5}
+
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if opts.sampled("/users/:id") {
+			sampled++
+		}
+	}
+
+	if sampled < 400 || sampled > 600 {
+		t.Errorf("Expected about half of the requests to be sampled, got %d of 1000", sampled)
+	}
+
+	if !(MiddlewareOptions{}).sampled("/users/:id") {
+		t.Error("Expected all requests to be sampled by default")
+	}
+}
+
+func TestGinMiddlewareErrorsAndPanics(t *testing.T) {
+	emitter := &testEmitter{}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// gin.Recovery outermost, so the panic passes through GinMiddleware
+	r.Use(gin.RecoveryWithWriter(io.Discard), GinMiddleware(emitter), GinPanicTracker(emitter))
+	r.GET("/fail", func(c *gin.Context) {
+		c.Error(errors.New("validation failed"))
+		c.Status(http.StatusBadRequest)
+	})
+	r.GET("/panic/:id", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	serveTestRequest(r, "GET", "/fail")
+
+	if len(emitter.events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(emitter.events))
+	}
+	errs, _ := emitter.events[0].Data["errors"].([]string)
+	if len(errs) != 1 || errs[0] != "validation failed" {
+		t.Errorf("Expected recorded gin error, got %v", emitter.events[0].Data["errors"])
+	}
+
+	for _, target := range []string{"/panic/1", "/panic/2"} {
+		w := serveTestRequest(r, "GET", target)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status 500, got %d", w.Code)
+		}
+	}
+
+	// http_panic from the tracker, then http_request from GinMiddleware, per request
+	if len(emitter.events) != 5 {
+		t.Fatalf("Expected 5 events, got %d", len(emitter.events))
+	}
+
+	panicEvent, requestEvent := emitter.events[1], emitter.events[2]
+	if panicEvent.Key != "http_panic" {
+		t.Fatalf("Expected http_panic event, got %s", panicEvent.Key)
+	}
+	if panicEvent.Data["panic"] != "boom" || panicEvent.Data["route"] != "/panic/:id" {
+		t.Errorf("Unexpected panic event data: %v", panicEvent.Data)
+	}
+	if panicEvent.Data["stack_hash"] == "" || panicEvent.Data["stack_hash"] != emitter.events[3].Data["stack_hash"] {
+		t.Errorf("Expected the same stack hash for panics from the same place, got %v and %v",
+			panicEvent.Data["stack_hash"], emitter.events[3].Data["stack_hash"])
+	}
+
+	if requestEvent.Key != "http_request" || requestEvent.Data["status_code"] != http.StatusInternalServerError || requestEvent.Data["panic"] != true {
+		t.Errorf("Expected http_request event for the panicking request, got %v", requestEvent)
+	}
+}
+
+func TestGinRecovery(t *testing.T) {
+	emitter := &testEmitter{}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(GinMiddleware(emitter), GinRecovery(emitter))
+	r.GET("/panic", func(c *gin.Context) {
+		panic(errors.New("nil pointer"))
+	})
+
+	w := serveTestRequest(r, "GET", "/panic")
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+
+	if len(emitter.events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(emitter.events))
+	}
+	if emitter.events[0].Key != "http_panic" || emitter.events[0].Data["panic"] != "nil pointer" {
+		t.Errorf("Unexpected panic event: %v", emitter.events[0])
+	}
+	if emitter.events[1].Data["status_code"] != http.StatusInternalServerError {
+		t.Errorf("Expected recorded status 500, got %v", emitter.events[1].Data["status_code"])
+	}
+}
+
+func TestGinRecoveryOutermost(t *testing.T) {
+	emitter := &testEmitter{}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// The usual order, the panic passes through GinMiddleware first
+	r.Use(GinRecovery(emitter), GinMiddleware(emitter))
+	r.GET("/a", func(c *gin.Context) {
+		panic("a")
+	})
+	r.GET("/b", func(c *gin.Context) {
+		panic("b")
+	})
+
+	serveTestRequest(r, "GET", "/a")
+	serveTestRequest(r, "GET", "/b")
+
+	var panics []Event
+	for _, e := range emitter.recorded() {
+		if e.Key == "http_panic" {
+			panics = append(panics, e)
+		}
+	}
+	if len(panics) != 2 {
+		t.Fatalf("Expected 2 panic events, got %d", len(panics))
+	}
+
+	for _, e := range panics {
+		location, _ := e.Data["location"].(string)
+		if !strings.Contains(location, "TestGinRecoveryOutermost") {
+			t.Errorf("Expected the location of the handler, got %q", location)
+		}
+	}
+	if panics[0].Data["stack_hash"] == panics[1].Data["stack_hash"] {
+		t.Error("Expected different stack hashes for panics from different places")
+	}
+}
@@ -0,0 +1,619 @@
+package tlytics
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Partition granularities for PartitionedStore
+const (
+	PartitionDaily   = "day"
+	PartitionMonthly = "month"
+)
+
+const partitionPrefix = "tlytics-"
+
+// sketchesFile holds the distinct count sketches and erasure records of all
+// partitions, so they outlive dropped partitions
+const sketchesFile = "sketches.sqlite"
+
+// maxOpenPartitions is how many partition files are kept open when idle, the
+// least recently used are closed beyond it
+const maxOpenPartitions = 16
+
+// partitionReaders is the size of the reader pool of each partition, queries
+// walk partitions in turn so few connections are needed
+const partitionReaders = 2
+
+// PartitionedStore writes events to one SQLite file per day or month in a
+// directory. Old data is dropped by deleting whole files, and queries only
+// open the partitions overlapping the requested time range.
+//
+// SQLite can attach at most 10 databases to a connection, so instead of one
+// UNION ALL over attached files each overlapping partition is queried in turn
+// and the results are merged. Partitions are opened as they are queried with a
+// small reader pool, and the least recently used are closed when more than
+// maxOpenPartitions are open.
+type PartitionedStore struct {
+	dir         string
+	granularity string
+	layout      string
+	retention   time.Duration
+	partitions  map[string]*openPartition
+	used        uint64 // Counter ordering the partitions by last use
+	sketches    *DB
+	hot         map[string][]string
+	mutex       sync.Mutex
+
+	// access is held for reading while partition handles are in use and for
+	// writing while partitions are dropped, so a drop waits for running queries
+	access sync.RWMutex
+}
+
+// openPartition is an open partition file and the queries using it
+type openPartition struct {
+	db       *DB
+	refs     int
+	lastUsed uint64
+}
+
+// partition is a partition file and the time range it covers
+type partition struct {
+	name  string
+	start time.Time
+	end   time.Time
+}
+
+// NewPartitionedStore opens a partitioned store in dir. Partitions whose whole
+// range is older than retention are dropped when a new partition is created,
+// 0 keeps everything.
+func NewPartitionedStore(dir, granularity string, retention time.Duration) (*PartitionedStore, error) {
+	var layout string
+	switch granularity {
+	case "", PartitionDaily:
+		granularity = PartitionDaily
+		layout = "2006-01-02"
+	case PartitionMonthly:
+		layout = "2006-01"
+	default:
+		return nil, fmt.Errorf("unknown partition granularity: %s", granularity)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create partition directory: %w", err)
+	}
+
+	return &PartitionedStore{
+		dir:         dir,
+		granularity: granularity,
+		layout:      layout,
+		retention:   retention,
+		partitions:  make(map[string]*openPartition),
+	}, nil
+}
+
+// partitionFor returns the partition holding events at t
+func (p *PartitionedStore) partitionFor(t time.Time) partition {
+	t = t.UTC()
+
+	var start, end time.Time
+	if p.granularity == PartitionMonthly {
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 1, 0)
+	} else {
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 0, 1)
+	}
+
+	return partition{
+		name:  partitionPrefix + start.Format(p.layout) + ".sqlite",
+		start: start,
+		end:   end,
+	}
+}
+
+// list returns the partitions in the directory, newest first
+func (p *PartitionedStore) list() ([]partition, error) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partition directory: %w", err)
+	}
+
+	var partitions []partition
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, partitionPrefix) || !strings.HasSuffix(name, ".sqlite") {
+			continue
+		}
+
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, partitionPrefix), ".sqlite")
+		start, err := time.Parse(p.layout, stamp)
+		if err != nil {
+			continue // not a partition of this granularity
+		}
+
+		partitions = append(partitions, p.partitionFor(start))
+	}
+
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].start.After(partitions[j].start)
+	})
+
+	return partitions, nil
+}
+
+// overlapping returns the partitions that can hold events matching the query, newest first
+func (p *PartitionedStore) overlapping(q Query) ([]partition, error) {
+	partitions, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []partition
+	for _, part := range partitions {
+		if !q.To.IsZero() && !part.start.Before(q.To) {
+			continue
+		}
+		if !q.From.IsZero() && !part.end.After(q.From) {
+			continue
+		}
+		result = append(result, part)
+	}
+
+	return result, nil
+}
+
+// open returns the database of a partition, creating the file if needed.
+// Callers hold access for reading and call release when done with it.
+func (p *PartitionedStore) open(part partition) (*DB, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.used++
+	if open, ok := p.partitions[part.name]; ok {
+		open.refs++
+		open.lastUsed = p.used
+		return open.db, nil
+	}
+
+	db, err := Init(filepath.Join(p.dir, part.name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partition %s: %w", part.name, err)
+	}
+	db.reader.SetMaxOpenConns(partitionReaders)
+	if len(p.hot) > 0 {
+		if err := db.SetHotFields(p.hot); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to open partition %s: %w", part.name, err)
+		}
+	}
+	p.partitions[part.name] = &openPartition{db: db, refs: 1, lastUsed: p.used}
+
+	return db, nil
+}
+
+// release ends a use of a partition returned by open and closes the least
+// recently used idle partitions beyond maxOpenPartitions
+func (p *PartitionedStore) release(part partition) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if open, ok := p.partitions[part.name]; ok {
+		open.refs--
+	}
+
+	for len(p.partitions) > maxOpenPartitions {
+		var oldest string
+		for name, open := range p.partitions {
+			if open.refs == 0 && (oldest == "" || open.lastUsed < p.partitions[oldest].lastUsed) {
+				oldest = name
+			}
+		}
+		if oldest == "" {
+			return // all in use
+		}
+		p.partitions[oldest].db.Close()
+		delete(p.partitions, oldest)
+	}
+}
+
+// withPartition calls fn with the database of the partition
+func (p *PartitionedStore) withPartition(part partition, fn func(db *DB) error) error {
+	db, err := p.open(part)
+	if err != nil {
+		return err
+	}
+	defer p.release(part)
+
+	return fn(db)
+}
+
+func (p *PartitionedStore) InsertEvents(events []Event) error {
+	batches := make(map[partition][]Event)
+	newPartition := false
+	for _, event := range events {
+		part := p.partitionFor(event.Timestamp)
+		if _, ok := batches[part]; !ok {
+			_, err := os.Stat(filepath.Join(p.dir, part.name))
+			newPartition = newPartition || os.IsNotExist(err)
+		}
+		batches[part] = append(batches[part], event)
+	}
+
+	// Starting a new partition is a good time to drop expired ones
+	if newPartition && p.retention > 0 {
+		if _, err := p.DropPartitionsBefore(time.Now().Add(-p.retention)); err != nil {
+			return err
+		}
+	}
+
+	p.access.RLock()
+	defer p.access.RUnlock()
+
+	for part, batch := range batches {
+		err := p.withPartition(part, func(db *DB) error {
+			return db.InsertEvents(batch)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to insert into partition %s: %w", part.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *PartitionedStore) GetEvents(limit, offset int) ([]Event, int, error) {
+	total, err := p.CountEvents(Query{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	events, err := p.QueryEvents(Query{Limit: limit, Offset: offset})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
+
+// QueryEvents walks the partitions newest first. Partitions don't overlap in
+// time, so the offset is skipped by counting whole partitions.
+func (p *PartitionedStore) QueryEvents(q Query) ([]Event, error) {
+	p.access.RLock()
+	defer p.access.RUnlock()
+
+	partitions, err := p.overlapping(q)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := q
+	filter.Limit, filter.Offset = 0, 0
+	offset := q.Offset
+
+	var events []Event
+	for _, part := range partitions {
+		err := p.withPartition(part, func(db *DB) error {
+			if offset > 0 {
+				count, err := db.CountEvents(filter)
+				if err != nil {
+					return err
+				}
+				if count <= offset {
+					offset -= count
+					return nil
+				}
+			}
+
+			partQuery := filter
+			partQuery.Offset = offset
+			if q.Limit > 0 {
+				partQuery.Limit = q.Limit - len(events)
+			}
+
+			partEvents, err := db.QueryEvents(partQuery)
+			if err != nil {
+				return err
+			}
+
+			events = append(events, partEvents...)
+			offset = 0
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if q.Limit > 0 && len(events) >= q.Limit {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+func (p *PartitionedStore) CountEvents(q Query) (int, error) {
+	p.access.RLock()
+	defer p.access.RUnlock()
+
+	partitions, err := p.overlapping(q)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, part := range partitions {
+		err := p.withPartition(part, func(db *DB) error {
+			count, err := db.CountEvents(q)
+			total += count
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+// Aggregate merges the buckets of each partition, buckets longer than a
+// partition are summed across files
+func (p *PartitionedStore) Aggregate(q Query, interval time.Duration) ([]AggregateBucket, error) {
+	if interval < time.Second {
+		return nil, fmt.Errorf("aggregate interval must be at least 1s, got %s", interval)
+	}
+
+	p.access.RLock()
+	defer p.access.RUnlock()
+
+	partitions, err := p.overlapping(q)
+	if err != nil {
+		return nil, err
+	}
+
+	type bucketID struct {
+		key   string
+		start int64
+	}
+
+	counts := make(map[bucketID]int)
+	for _, part := range partitions {
+		err := p.withPartition(part, func(db *DB) error {
+			buckets, err := db.Aggregate(q, interval)
+			for _, bucket := range buckets {
+				counts[bucketID{key: bucket.Key, start: bucket.Start.Unix()}] += bucket.Count
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	buckets := make([]AggregateBucket, 0, len(counts))
+	for id, count := range counts {
+		buckets = append(buckets, AggregateBucket{
+			Key:   id.key,
+			Start: time.Unix(id.start, 0).UTC(),
+			Count: count,
+		})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		if !buckets[i].Start.Equal(buckets[j].Start) {
+			return buckets[i].Start.Before(buckets[j].Start)
+		}
+		return buckets[i].Key < buckets[j].Key
+	})
+
+	return buckets, nil
+}
+
+// SetHotFields adds the hot field columns to the open partitions and to each
+// partition opened later
+func (p *PartitionedStore) SetHotFields(fields map[string][]string) error {
+	if _, err := hotFieldSet(fields); err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for name, open := range p.partitions {
+		if err := open.db.SetHotFields(fields); err != nil {
+			return fmt.Errorf("failed to set hot fields of partition %s: %w", name, err)
+		}
+	}
+	p.hot = fields
+
+	return nil
+}
+
+// Breakdown merges the groups of each partition before ordering and limiting them
+func (p *PartitionedStore) Breakdown(q Query, b Breakdown) ([]BreakdownGroup, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	p.access.RLock()
+	defer p.access.RUnlock()
+
+	partitions, err := p.overlapping(q)
+	if err != nil {
+		return nil, err
+	}
+
+	partQuery := q
+	partQuery.Limit = 0
+
+	groups := make(map[string]*BreakdownGroup)
+	for _, part := range partitions {
+		var partGroups []BreakdownGroup
+		err := p.withPartition(part, func(db *DB) error {
+			var err error
+			partGroups, err = db.Breakdown(partQuery, b)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, group := range partGroups {
+			id := strings.Join(group.Values, "\x00")
+			if merged, ok := groups[id]; ok {
+				merged.merge(group)
+			} else {
+				group := group
+				groups[id] = &group
+			}
+		}
+	}
+
+	return sortBreakdown(groups, b, q.Limit), nil
+}
+
+// DeleteEvents removes the events matching the query filters, at most Limit
+// if set. Offset is ignored. Use DropPartitionsBefore to remove old data cheaply.
+func (p *PartitionedStore) DeleteEvents(q Query) (int64, error) {
+	p.access.RLock()
+	defer p.access.RUnlock()
+
+	partitions, err := p.overlapping(q)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, part := range partitions {
+		partQuery := q
+		if q.Limit > 0 {
+			partQuery.Limit = q.Limit - int(deleted)
+		}
+
+		err := p.withPartition(part, func(db *DB) error {
+			n, err := db.DeleteEvents(partQuery)
+			deleted += n
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		if q.Limit > 0 && deleted >= int64(q.Limit) {
+			break
+		}
+	}
+
+	return deleted, nil
+}
+
+// DropPartitionsBefore deletes the partition files whose whole range ends at
+// or before t. It waits for running queries on the partitions to finish.
+func (p *PartitionedStore) DropPartitionsBefore(t time.Time) (int, error) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	partitions, err := p.list()
+	if err != nil {
+		return 0, err
+	}
+
+	dropped := 0
+	for _, part := range partitions {
+		if part.end.After(t) {
+			continue
+		}
+
+		if open, ok := p.partitions[part.name]; ok {
+			open.db.Close()
+			delete(p.partitions, part.name)
+		}
+
+		path := filepath.Join(p.dir, part.name)
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+				return dropped, fmt.Errorf("failed to remove partition %s: %w", part.name, err)
+			}
+		}
+
+		dropped++
+	}
+
+	return dropped, nil
+}
+
+// sketchDB returns the database of the sketches and erasure records, creating the file if needed
+func (p *PartitionedStore) sketchDB() (*DB, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.sketches == nil {
+		db, err := Init(filepath.Join(p.dir, sketchesFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sketches: %w", err)
+		}
+		p.sketches = db
+	}
+
+	return p.sketches, nil
+}
+
+func (p *PartitionedStore) MergeSketches(sketches []Sketch) error {
+	db, err := p.sketchDB()
+	if err != nil {
+		return err
+	}
+	return db.MergeSketches(sketches)
+}
+
+func (p *PartitionedStore) QuerySketches(q Query, field string) ([]Sketch, error) {
+	db, err := p.sketchDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.QuerySketches(q, field)
+}
+
+func (p *PartitionedStore) InsertErasure(record ErasureRecord) error {
+	db, err := p.sketchDB()
+	if err != nil {
+		return err
+	}
+	return db.InsertErasure(record)
+}
+
+func (p *PartitionedStore) Erasures() ([]ErasureRecord, error) {
+	db, err := p.sketchDB()
+	if err != nil {
+		return nil, err
+	}
+	return db.Erasures()
+}
+
+func (p *PartitionedStore) Close() error {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var firstErr error
+	if p.sketches != nil {
+		firstErr = p.sketches.Close()
+		p.sketches = nil
+	}
+	for name, open := range p.partitions {
+		if err := open.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(p.partitions, name)
+	}
+
+	return firstErr
+}
@@ -0,0 +1,186 @@
+package tlytics
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPartitionedStoreAcrossDays(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewPartitionedStore(dir, PartitionDaily, 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize partitioned store: %v", err)
+	}
+	defer store.Close()
+
+	// Two events per day on three days
+	day := time.Date(2025, 8, 23, 0, 0, 0, 0, time.UTC)
+	var events []Event
+	for d := 0; d < 3; d++ {
+		for h := 0; h < 2; h++ {
+			events = append(events, Event{
+				Key:       "view",
+				Timestamp: day.AddDate(0, 0, d).Add(time.Duration(10+h) * time.Hour),
+				Data:      map[string]interface{}{"day": d, "hour": h},
+			})
+		}
+	}
+
+	if err := store.InsertEvents(events); err != nil {
+		t.Fatalf("Failed to insert events: %v", err)
+	}
+
+	for _, name := range []string{"tlytics-2025-08-23.sqlite", "tlytics-2025-08-24.sqlite", "tlytics-2025-08-25.sqlite"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected partition file %s: %v", name, err)
+		}
+	}
+
+	// Only the middle partition overlaps this range
+	parts, err := store.overlapping(Query{From: day.AddDate(0, 0, 1), To: day.AddDate(0, 0, 2)})
+	if err != nil {
+		t.Fatalf("Failed to list partitions: %v", err)
+	}
+	if len(parts) != 1 || parts[0].name != "tlytics-2025-08-24.sqlite" {
+		t.Errorf("Expected only the 2025-08-24 partition, got %v", parts)
+	}
+
+	// A page spanning two partitions, newest first
+	page, total, err := store.GetEvents(3, 1)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	if total != 6 {
+		t.Errorf("Expected 6 events, got %d", total)
+	}
+	if len(page) != 3 {
+		t.Fatalf("Expected 3 events on the page, got %d", len(page))
+	}
+	expected := []time.Time{events[4].Timestamp, events[3].Timestamp, events[2].Timestamp}
+	for i := range expected {
+		if !page[i].Timestamp.Equal(expected[i]) {
+			t.Errorf("Event %d: expected timestamp %s, got %s", i, expected[i], page[i].Timestamp)
+		}
+	}
+
+	// Daily buckets count events across files
+	buckets, err := store.Aggregate(Query{}, 48*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to aggregate events: %v", err)
+	}
+	sum := 0
+	for _, bucket := range buckets {
+		sum += bucket.Count
+	}
+	if sum != 6 {
+		t.Errorf("Expected buckets to add up to 6 events, got %v", buckets)
+	}
+
+	// Dropping removes whole files
+	dropped, err := store.DropPartitionsBefore(day.AddDate(0, 0, 2))
+	if err != nil {
+		t.Fatalf("Failed to drop partitions: %v", err)
+	}
+	if dropped != 2 {
+		t.Errorf("Expected 2 dropped partitions, got %d", dropped)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tlytics-2025-08-23.sqlite")); !os.IsNotExist(err) {
+		t.Error("Expected the 2025-08-23 partition file to be removed")
+	}
+
+	count, err := store.CountEvents(Query{})
+	if err != nil {
+		t.Fatalf("Failed to count events: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 events left, got %d", count)
+	}
+}
+
+func TestPartitionedStoreDropDuringQueries(t *testing.T) {
+	store, err := NewPartitionedStore(t.TempDir(), PartitionDaily, 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize partitioned store: %v", err)
+	}
+	defer store.Close()
+
+	day := time.Date(2025, 8, 1, 12, 0, 0, 0, time.UTC)
+	var events []Event
+	for i := 0; i < 10; i++ {
+		events = append(events, Event{Key: "view", Timestamp: day.AddDate(0, 0, i), Data: map[string]interface{}{"n": i}})
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			if _, err := store.QueryEvents(Query{}); err != nil {
+				done <- err
+				return
+			}
+			if _, err := store.Aggregate(Query{}, time.Hour); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	// Recreate and drop the partitions while the queries run
+	for i := 0; i < 50; i++ {
+		if err := store.InsertEvents(events); err != nil {
+			t.Fatalf("Failed to insert events: %v", err)
+		}
+		if _, err := store.DropPartitionsBefore(day.AddDate(0, 1, 0)); err != nil {
+			t.Fatalf("Failed to drop partitions: %v", err)
+		}
+	}
+	close(stop)
+
+	if err := <-done; err != nil {
+		t.Errorf("Expected drops to wait for running queries, got %v", err)
+	}
+}
+
+func TestPartitionedStoreLimitsOpenPartitions(t *testing.T) {
+	store, err := NewPartitionedStore(t.TempDir(), PartitionDaily, 0)
+	if err != nil {
+		t.Fatalf("Failed to initialize partitioned store: %v", err)
+	}
+	defer store.Close()
+
+	day := time.Date(2025, 8, 1, 12, 0, 0, 0, time.UTC)
+	var events []Event
+	for d := 0; d < 3*maxOpenPartitions; d++ {
+		events = append(events, Event{Key: "view", Timestamp: day.AddDate(0, 0, d)})
+	}
+	if err := store.InsertEvents(events); err != nil {
+		t.Fatalf("Failed to insert events: %v", err)
+	}
+
+	// Queries without a time range walk every partition
+	count, err := store.CountEvents(Query{})
+	if err != nil {
+		t.Fatalf("Failed to count events: %v", err)
+	}
+	if count != len(events) {
+		t.Errorf("Expected %d events, got %d", len(events), count)
+	}
+
+	if open := len(store.partitions); open > maxOpenPartitions {
+		t.Errorf("Expected at most %d open partitions, got %d", maxOpenPartitions, open)
+	}
+	for name, open := range store.partitions {
+		if open.refs != 0 {
+			t.Errorf("Expected partition %s to be released, got %d uses", name, open.refs)
+		}
+	}
+}
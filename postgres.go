@@ -0,0 +1,593 @@
+package tlytics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore stores events in PostgreSQL. The data column is JSONB with a
+// GIN index and the table is partitioned by month on the timestamp.
+type PostgresStore struct {
+	pool       *pgxpool.Pool
+	partitions map[string]bool
+	hot        hotFields // Data fields with a generated column and index per key, see SetHotFields
+	mutex      sync.Mutex
+}
+
+func NewPostgresStore(databaseURL string) (*PostgresStore, error) {
+	ctx := context.Background()
+
+	pool, err := pgxpool.New(ctx, databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	store := &PostgresStore{
+		pool:       pool,
+		partitions: make(map[string]bool),
+	}
+
+	if err := store.createTableIfNotExists(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (p *PostgresStore) createTableIfNotExists(ctx context.Context) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS tlytics (
+			key TEXT NOT NULL,
+			timestamp TIMESTAMPTZ NOT NULL,
+			data JSONB
+		) PARTITION BY RANGE (timestamp)`,
+		`CREATE INDEX IF NOT EXISTS tlytics_key_timestamp_idx ON tlytics (key, timestamp)`,
+		`CREATE INDEX IF NOT EXISTS tlytics_data_idx ON tlytics USING GIN (data jsonb_path_ops)`,
+		`CREATE TABLE IF NOT EXISTS tlytics_sketches (
+			key TEXT NOT NULL,
+			field TEXT NOT NULL,
+			start BIGINT NOT NULL,
+			registers BYTEA NOT NULL,
+			PRIMARY KEY (key, field, start)
+		)`,
+		`CREATE TABLE IF NOT EXISTS tlytics_erasures (
+			field TEXT NOT NULL,
+			value_hash TEXT NOT NULL,
+			deleted BIGINT NOT NULL,
+			batches INTEGER NOT NULL,
+			started_at TIMESTAMPTZ NOT NULL,
+			finished_at TIMESTAMPTZ NOT NULL,
+			error TEXT NOT NULL
+		)`,
+	}
+
+	for _, statement := range statements {
+		if _, err := p.pool.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// SetHotFields adds a stored generated column holding the text of each hot
+// field, and a partial index on column and timestamp for each key the field
+// is hot for. Adding a column rewrites the existing rows once. Columns and
+// indexes no longer configured are left in place.
+func (p *PostgresStore) SetHotFields(fields map[string][]string) error {
+	hot, err := hotFieldSet(fields)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for _, field := range hot.columns() {
+		column := hotColumn(field)
+
+		// Unquoted column names fold to lower case, so the column may exist for a field differing in case
+		var expression string
+		err := p.pool.QueryRow(ctx,
+			"SELECT generation_expression FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'tlytics' AND column_name = $1",
+			strings.ToLower(column)).Scan(&expression)
+		if err != nil && err != pgx.ErrNoRows {
+			return fmt.Errorf("failed to read column %s: %w", column, err)
+		}
+		if err == nil && !strings.Contains(expression, "'"+field+"'") {
+			return fmt.Errorf("hot field %q collides with column %s of a field differing only in case", field, strings.ToLower(column))
+		}
+
+		statements := []string{
+			fmt.Sprintf("ALTER TABLE tlytics ADD COLUMN IF NOT EXISTS %s TEXT GENERATED ALWAYS AS (data->>'%s') STORED", column, field),
+		}
+		for _, key := range hot.keys(field) {
+			statements = append(statements, hotIndex(field, key))
+		}
+		for _, statement := range statements {
+			if _, err := p.pool.Exec(ctx, statement); err != nil {
+				return fmt.Errorf("failed to add column %s: %w", column, err)
+			}
+		}
+	}
+
+	p.hot = hot
+	return nil
+}
+
+// partitionName returns the name of the monthly partition holding t
+func partitionName(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("tlytics_y%04dm%02d", t.Year(), int(t.Month()))
+}
+
+// ensurePartitions creates the monthly partitions needed for the events
+func (p *PostgresStore) ensurePartitions(ctx context.Context, events []Event) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, event := range events {
+		name := partitionName(event.Timestamp)
+		if p.partitions[name] {
+			continue
+		}
+
+		t := event.Timestamp.UTC()
+		from := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		to := from.AddDate(0, 1, 0)
+
+		statement := fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s PARTITION OF tlytics FOR VALUES FROM ('%s') TO ('%s')",
+			name, from.Format(time.RFC3339), to.Format(time.RFC3339),
+		)
+		if _, err := p.pool.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("failed to create partition %s: %w", name, err)
+		}
+
+		p.partitions[name] = true
+	}
+
+	return nil
+}
+
+// InsertEvents writes the events with COPY
+func (p *PostgresStore) InsertEvents(events []Event) error {
+	ctx := context.Background()
+
+	if err := p.ensurePartitions(ctx, events); err != nil {
+		return err
+	}
+
+	rows := make([][]interface{}, 0, len(events))
+	for _, event := range events {
+		dataJSON, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+
+		rows = append(rows, []interface{}{event.Key, event.Timestamp.UTC(), dataJSON})
+	}
+
+	_, err := p.pool.CopyFrom(ctx, pgx.Identifier{"tlytics"}, []string{"key", "timestamp", "data"}, pgx.CopyFromRows(rows))
+	if err != nil {
+		return fmt.Errorf("failed to copy events: %w", err)
+	}
+
+	return nil
+}
+
+func (p *PostgresStore) GetEvents(limit, offset int) ([]Event, int, error) {
+	total, err := p.CountEvents(Query{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	events, err := p.QueryEvents(Query{Limit: limit, Offset: offset})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
+
+func (p *PostgresStore) QueryEvents(q Query) ([]Event, error) {
+	where, args := p.whereClause(q)
+	query := "SELECT key, timestamp, data FROM tlytics" + where + " ORDER BY timestamp DESC"
+
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if q.Offset > 0 {
+		args = append(args, q.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	rows, err := p.pool.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+
+		if err := rows.Scan(&event.Key, &event.Timestamp, &event.Data); err != nil {
+			return nil, err
+		}
+
+		event.Timestamp = event.Timestamp.UTC()
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (p *PostgresStore) CountEvents(q Query) (int, error) {
+	where, args := p.whereClause(q)
+
+	var count int
+	err := p.pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM tlytics"+where, args...).Scan(&count)
+	return count, err
+}
+
+func (p *PostgresStore) Aggregate(q Query, interval time.Duration) ([]AggregateBucket, error) {
+	if interval < time.Second {
+		return nil, fmt.Errorf("aggregate interval must be at least 1s, got %s", interval)
+	}
+
+	where, args := p.whereClause(q)
+	args = append(args, int64(interval/time.Second))
+	n := len(args)
+
+	query := fmt.Sprintf(
+		"SELECT key, (floor(extract(epoch FROM timestamp) / $%d) * $%d)::bigint AS bucket, COUNT(*) FROM tlytics%s GROUP BY key, bucket ORDER BY bucket, key",
+		n, n, where,
+	)
+
+	rows, err := p.pool.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make([]AggregateBucket, 0)
+	for rows.Next() {
+		var bucket AggregateBucket
+		var start int64
+
+		if err := rows.Scan(&bucket.Key, &start, &bucket.Count); err != nil {
+			return nil, err
+		}
+
+		bucket.Start = time.Unix(start, 0).UTC()
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, rows.Err()
+}
+
+// Breakdown groups the events matching the query. At most Limit groups are
+// returned, Offset is ignored.
+func (p *PostgresStore) Breakdown(q Query, b Breakdown) ([]BreakdownGroup, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+
+	where, args := p.whereClause(q)
+
+	var columns, groupBy, notNull []string
+	for i, field := range b.Fields {
+		// Byte order for ties, like SQLite and Go
+		if p.hot.has(q.Key, field) {
+			columns = append(columns, fmt.Sprintf("%s COLLATE \"C\" AS v%d", hotColumn(field), i))
+		} else {
+			args = append(args, field)
+			columns = append(columns, fmt.Sprintf("(data->>$%d) COLLATE \"C\" AS v%d", len(args), i))
+		}
+		groupBy = append(groupBy, fmt.Sprintf("v%d", i))
+		notNull = append(notNull, fmt.Sprintf("v%d IS NOT NULL", i))
+	}
+
+	if b.Sum != "" {
+		args = append(args, b.Sum)
+		columns = append(columns, fmt.Sprintf("CASE WHEN jsonb_typeof(data->$%d) = 'number' THEN (data->>$%d)::float8 END AS n", len(args), len(args)))
+	} else {
+		columns = append(columns, "NULL::float8 AS n")
+	}
+
+	order := "COUNT(*) DESC"
+	switch b.OrderBy {
+	case OrderBySum:
+		order = "COALESCE(SUM(n), 0) DESC"
+	case OrderByAvg:
+		order = "AVG(n) DESC NULLS LAST"
+	}
+
+	query := "SELECT " + strings.Join(groupBy, ", ") + ", COUNT(*), COALESCE(SUM(n), 0), COUNT(n) FROM (SELECT " +
+		strings.Join(columns, ", ") + " FROM tlytics" + where + ") AS grouped WHERE " + strings.Join(notNull, " AND ") +
+		" GROUP BY " + strings.Join(groupBy, ", ") + " ORDER BY " + order + ", " + strings.Join(groupBy, ", ")
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := p.pool.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]BreakdownGroup, 0)
+	for rows.Next() {
+		group := BreakdownGroup{Values: make([]string, len(b.Fields))}
+		var count, numeric int64
+		var sum float64
+
+		dest := make([]interface{}, 0, len(b.Fields)+3)
+		for i := range group.Values {
+			dest = append(dest, &group.Values[i])
+		}
+		dest = append(dest, &count, &sum, &numeric)
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		group.Count = int(count)
+		group.numeric = int(numeric)
+		if b.Sum != "" {
+			group.Sum = &sum
+			group.setAvg()
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+// DeleteEvents removes the events matching the query filters. A Limit caps the
+// number of deleted events, Offset is ignored.
+func (p *PostgresStore) DeleteEvents(q Query) (int64, error) {
+	where, args := p.whereClause(q)
+	query := "DELETE FROM tlytics" + where
+	if q.Limit > 0 {
+		// ctid is only unique within a partition
+		args = append(args, q.Limit)
+		query = fmt.Sprintf("DELETE FROM tlytics WHERE (tableoid, ctid) IN (SELECT tableoid, ctid FROM tlytics%s LIMIT $%d)", where, len(args))
+	}
+
+	tag, err := p.pool.Exec(context.Background(), query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// DropPartitionsBefore drops the monthly partitions that end at or before t.
+// This is much cheaper than deleting old events row by row.
+func (p *PostgresStore) DropPartitionsBefore(t time.Time) (int, error) {
+	ctx := context.Background()
+
+	rows, err := p.pool.Query(ctx, `
+		SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'tlytics'::regclass`)
+	if err != nil {
+		return 0, err
+	}
+
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	dropped := 0
+	for _, name := range names {
+		start, err := time.Parse("tlytics_y2006m01", name)
+		if err != nil {
+			continue // not one of our monthly partitions
+		}
+
+		if start.AddDate(0, 1, 0).After(t.UTC()) {
+			continue
+		}
+
+		if _, err := p.pool.Exec(ctx, "DROP TABLE IF EXISTS "+pgx.Identifier{name}.Sanitize()); err != nil {
+			return dropped, fmt.Errorf("failed to drop partition %s: %w", name, err)
+		}
+
+		delete(p.partitions, name)
+		dropped++
+	}
+
+	return dropped, nil
+}
+
+// MergeSketches merges the sketches into the stored ones in one transaction,
+// locking the stored rows so concurrent merges don't lose updates
+func (p *PostgresStore) MergeSketches(sketches []Sketch) error {
+	ctx := context.Background()
+
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, sketch := range sketches {
+		hll := NewHyperLogLog()
+		hll.Merge(sketch.HLL)
+
+		// Make sure the row exists, so it can be locked
+		_, err := tx.Exec(ctx,
+			"INSERT INTO tlytics_sketches (key, field, start, registers) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+			sketch.Key, sketch.Field, sketch.Start.Unix(), []byte{hllSparse})
+		if err != nil {
+			return err
+		}
+
+		var stored []byte
+		err = tx.QueryRow(ctx,
+			"SELECT registers FROM tlytics_sketches WHERE key = $1 AND field = $2 AND start = $3 FOR UPDATE",
+			sketch.Key, sketch.Field, sketch.Start.Unix()).Scan(&stored)
+		if err != nil {
+			return err
+		}
+
+		existing := NewHyperLogLog()
+		if err := existing.UnmarshalBinary(stored); err != nil {
+			return err
+		}
+		hll.Merge(existing)
+
+		registers, err := hll.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx,
+			"UPDATE tlytics_sketches SET registers = $4 WHERE key = $1 AND field = $2 AND start = $3",
+			sketch.Key, sketch.Field, sketch.Start.Unix(), registers)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// QuerySketches returns the sketches of the field starting in the query's time range
+func (p *PostgresStore) QuerySketches(q Query, field string) ([]Sketch, error) {
+	query := "SELECT key, start, registers FROM tlytics_sketches WHERE field = $1"
+	args := []interface{}{field}
+	if q.Key != "" {
+		args = append(args, q.Key)
+		query += fmt.Sprintf(" AND key = $%d", len(args))
+	}
+	if !q.From.IsZero() {
+		args = append(args, q.From.Unix())
+		query += fmt.Sprintf(" AND start >= $%d", len(args))
+	}
+	if !q.To.IsZero() {
+		args = append(args, q.To.Unix())
+		query += fmt.Sprintf(" AND start < $%d", len(args))
+	}
+
+	rows, err := p.pool.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sketches []Sketch
+	for rows.Next() {
+		var sketch Sketch
+		var start int64
+		var registers []byte
+
+		if err := rows.Scan(&sketch.Key, &start, &registers); err != nil {
+			return nil, err
+		}
+
+		sketch.Field = field
+		sketch.Start = time.Unix(start, 0).UTC()
+		sketch.HLL = NewHyperLogLog()
+		if err := sketch.HLL.UnmarshalBinary(registers); err != nil {
+			return nil, err
+		}
+		sketches = append(sketches, sketch)
+	}
+
+	return sketches, rows.Err()
+}
+
+// InsertErasure stores the record of an erasure
+func (p *PostgresStore) InsertErasure(record ErasureRecord) error {
+	_, err := p.pool.Exec(context.Background(),
+		"INSERT INTO tlytics_erasures (field, value_hash, deleted, batches, started_at, finished_at, error) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		record.Field, record.ValueHash, record.Deleted, record.Batches, record.StartedAt, record.FinishedAt, record.Error)
+	return err
+}
+
+// Erasures returns the stored erasure records, newest first
+func (p *PostgresStore) Erasures() ([]ErasureRecord, error) {
+	rows, err := p.pool.Query(context.Background(),
+		"SELECT field, value_hash, deleted, batches, started_at, finished_at, error FROM tlytics_erasures ORDER BY finished_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]ErasureRecord, 0)
+	for rows.Next() {
+		var r ErasureRecord
+		if err := rows.Scan(&r.Field, &r.ValueHash, &r.Deleted, &r.Batches, &r.StartedAt, &r.FinishedAt, &r.Error); err != nil {
+			return nil, err
+		}
+		r.StartedAt, r.FinishedAt = r.StartedAt.UTC(), r.FinishedAt.UTC()
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+func (p *PostgresStore) Close() error {
+	p.pool.Close()
+	return nil
+}
+
+// whereClause is DB.whereClause with PostgreSQL placeholders
+func (p *PostgresStore) whereClause(q Query) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if q.Key != "" {
+		args = append(args, q.Key)
+		conds = append(conds, fmt.Sprintf("key = $%d", len(args)))
+	}
+	if !q.From.IsZero() {
+		args = append(args, q.From.UTC())
+		conds = append(conds, fmt.Sprintf("timestamp >= $%d", len(args)))
+	}
+	if !q.To.IsZero() {
+		args = append(args, q.To.UTC())
+		conds = append(conds, fmt.Sprintf("timestamp < $%d", len(args)))
+	}
+	if q.ExcludeBots {
+		conds = append(conds, "COALESCE(data->>'is_bot', 'false') <> 'true'")
+	}
+	if q.Field != "" && p.hot.has(q.Key, q.Field) {
+		args = append(args, q.Value)
+		conds = append(conds, fmt.Sprintf("%s = $%d", hotColumn(q.Field), len(args)))
+	} else if q.Field != "" {
+		args = append(args, q.Field, q.Value)
+		conds = append(conds, fmt.Sprintf("data->>$%d = $%d", len(args)-1, len(args)))
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
@@ -0,0 +1,134 @@
+package tlytics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// ErrRawPII is returned when emitting an event with a field flagged as raw PII
+var ErrRawPII = errors.New("event contains raw PII")
+
+// processEvent runs the processors and then checks the result for raw PII.
+// It returns false without an error if a processor dropped the event.
+func processEvent(processors []Processor, rawPII []string, e *Event) (bool, error) {
+	before := rawPIIValues(rawPII, *e)
+
+	if !applyProcessors(processors, e) {
+		return false, nil
+	}
+
+	if err := checkRawPII(rawPII, before, *e); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rawPIIValues returns the values of the raw PII fields before processing
+func rawPIIValues(fields []string, e Event) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, field := range fields {
+		if v, ok := e.Data[field]; ok {
+			values[field] = v
+		}
+	}
+	return values
+}
+
+// checkRawPII returns an error wrapping ErrRawPII if the processed event has
+// any of the fields with a raw value: unchanged by the processors, or added
+// by one. Fields hashed, truncated or redacted by a processor are allowed.
+func checkRawPII(fields []string, before map[string]interface{}, e Event) error {
+	for _, field := range fields {
+		v, ok := e.Data[field]
+		if !ok {
+			continue
+		}
+		if original, had := before[field]; had && !reflect.DeepEqual(original, v) {
+			continue
+		}
+		return fmt.Errorf("%w: field %s is not allowed", ErrRawPII, field)
+	}
+	return nil
+}
+
+// TruncateIP replaces IP addresses in the fields with their network, /24 for
+// IPv4 and /48 for IPv6. The client_ip field is used if no fields are given.
+func TruncateIP(fields ...string) Processor {
+	if len(fields) == 0 {
+		fields = []string{"client_ip"}
+	}
+
+	return func(e *Event) bool {
+		for _, field := range fields {
+			s, ok := e.Data[field].(string)
+			if !ok {
+				continue
+			}
+			if ip, err := netip.ParseAddr(s); err == nil {
+				e.Data[field] = truncateIP(ip)
+			}
+		}
+		return true
+	}
+}
+
+func truncateIP(ip netip.Addr) string {
+	ip = ip.Unmap()
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.Addr().String()
+}
+
+// RotatingSalt derives the hashing key from a secret and the event's time, so
+// hashes of the same value can only be joined within one period
+type RotatingSalt struct {
+	Secret []byte
+	Period time.Duration // e.g. 24 * time.Hour, 0 never rotates
+}
+
+// key returns the salt for the period containing t
+func (s RotatingSalt) key(t time.Time) []byte {
+	if s.Period <= 0 {
+		return s.Secret
+	}
+
+	period := t.UTC().Truncate(s.Period).Unix()
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(strconv.FormatInt(period, 10)))
+	return mac.Sum(nil)
+}
+
+// hash returns the keyed hash of the value as 32 hex characters
+func (s RotatingSalt) hash(t time.Time, value interface{}) string {
+	mac := hmac.New(sha256.New, s.key(t))
+	fmt.Fprint(mac, value)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// HashFields replaces the values of the fields, e.g. user_id, email or
+// client_ip, with their keyed hash. The salt for the event's timestamp is used,
+// so equal values hash equally within a salt period.
+func HashFields(salt RotatingSalt, fields ...string) Processor {
+	return func(e *Event) bool {
+		for _, field := range fields {
+			if v, ok := e.Data[field]; ok && v != nil {
+				e.Data[field] = salt.hash(e.Timestamp, v)
+			}
+		}
+		return true
+	}
+}
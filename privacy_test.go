@@ -0,0 +1,135 @@
+package tlytics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTruncateIP(t *testing.T) {
+	truncate := TruncateIP("client_ip", "peer")
+
+	tests := map[string]string{
+		"192.168.1.123":           "192.168.1.0",
+		"2001:db8:abcd:12::1":     "2001:db8:abcd::",
+		"::ffff:10.1.2.3":         "10.1.2.0",
+		"not an ip":               "not an ip",
+		"fe80::1%eth0":            "fe80::",
+		"2001:db8:abcd:ffff::ab1": "2001:db8:abcd::",
+	}
+
+	for input, expected := range tests {
+		e := Event{Key: "http_request", Data: map[string]interface{}{"client_ip": input}}
+		truncate(&e)
+		if e.Data["client_ip"] != expected {
+			t.Errorf("TruncateIP(%q) = %v, expected %q", input, e.Data["client_ip"], expected)
+		}
+	}
+}
+
+func TestHashFieldsSaltRotation(t *testing.T) {
+	hash := HashFields(RotatingSalt{Secret: []byte("secret"), Period: 24 * time.Hour}, "user_id", "email")
+
+	hashAt := func(ts time.Time, userID interface{}) interface{} {
+		e := Event{Key: "login", Timestamp: ts, Data: map[string]interface{}{"user_id": userID}}
+		hash(&e)
+		return e.Data["user_id"]
+	}
+
+	morning := time.Date(2025, 8, 25, 8, 0, 0, 0, time.UTC)
+	evening := time.Date(2025, 8, 25, 20, 0, 0, 0, time.UTC)
+	nextDay := time.Date(2025, 8, 26, 8, 0, 0, 0, time.UTC)
+
+	first := hashAt(morning, "u1")
+	if first == "u1" || len(first.(string)) != 32 {
+		t.Fatalf("Expected a 32 character hash, got %v", first)
+	}
+	if hashAt(evening, "u1") != first {
+		t.Error("Expected the same hash within a salt period")
+	}
+	if hashAt(nextDay, "u1") == first {
+		t.Error("Expected a different hash after the salt rotates")
+	}
+	if hashAt(morning, "u2") == first {
+		t.Error("Expected different values to hash differently")
+	}
+	if hashAt(morning, 42) != hashAt(evening, "42") {
+		t.Error("Expected numbers to hash like their string form")
+	}
+}
+
+func TestRawPIIPolicy(t *testing.T) {
+	store := NewMemoryStore()
+	logger := NewLogger(store, time.Hour)
+	logger.rawPII = []string{"email", "phone"}
+	defer logger.Stop()
+
+	err := logger.Emit(Event{Key: "signup", Data: map[string]interface{}{"email": "jane@example.com"}})
+	if !errors.Is(err, ErrRawPII) {
+		t.Errorf("Expected ErrRawPII, got %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	server := newHTTPServer(logger, store, 0)
+	r := server.router()
+
+	// A batch with one offending event is rejected as a whole
+	body := `[{"key": "signup", "data": {"user_id": "u1"}}, {"key": "signup", "data": {"phone": "555-0100"}}]`
+	req := httptest.NewRequest("POST", "/events", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "phone") {
+		t.Errorf("Expected the error to name the field, got %s", w.Body.String())
+	}
+
+	logger.Flush()
+	if count, _ := store.CountEvents(Query{}); count != 0 {
+		t.Errorf("Expected no events to be stored, got %d", count)
+	}
+}
+
+func TestRawPIIPolicyAfterProcessors(t *testing.T) {
+	store := NewMemoryStore()
+	salt := RotatingSalt{Secret: []byte("secret")}
+	addPhone := func(e *Event) bool {
+		e.Data["phone"] = "555-0100"
+		return true
+	}
+	logger := NewLogger(store, time.Hour, HashFields(salt, "email"), TruncateIP(), addPhone)
+	logger.rawPII = []string{"email", "client_ip", "phone"}
+	defer logger.Stop()
+
+	// email and client_ip are anonymized, but the phone added by a processor is raw
+	err := logger.Emit(Event{Key: "signup", Data: map[string]interface{}{"email": "jane@example.com", "client_ip": "192.0.2.77"}})
+	if err == nil {
+		t.Fatal("Expected the phone added by a processor to be rejected")
+	}
+	if !errors.Is(err, ErrRawPII) || !strings.Contains(err.Error(), "phone") {
+		t.Errorf("Expected ErrRawPII for phone, got %v", err)
+	}
+
+	hashOnly := NewLogger(store, time.Hour, HashFields(salt, "email"), TruncateIP())
+	hashOnly.rawPII = logger.rawPII
+	defer hashOnly.Stop()
+
+	err = hashOnly.Emit(Event{Key: "signup", Data: map[string]interface{}{"email": "jane@example.com", "client_ip": "192.0.2.77"}})
+	if err != nil {
+		t.Errorf("Expected hashed and truncated fields to be accepted, got %v", err)
+	}
+	hashOnly.Flush()
+
+	events, _ := store.QueryEvents(Query{})
+	if len(events) != 1 || events[0].Data["email"] == "jane@example.com" || events[0].Data["client_ip"] != "192.0.2.0" {
+		t.Errorf("Expected one anonymized event, got %v", events)
+	}
+}
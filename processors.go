@@ -0,0 +1,133 @@
+package tlytics
+
+import "regexp"
+
+// Processor changes an event before it is queued. It can change the key,
+// the timestamp and the data, and drops the event by returning false.
+type Processor func(e *Event) bool
+
+// Redacted replaces the values removed by the redaction processors
+const Redacted = "[REDACTED]"
+
+// applyProcessors runs the processors in order on a deep copy of the event
+// data, so callers' maps, nested ones included, are not changed. It returns false if a processor dropped the event.
+func applyProcessors(processors []Processor, e *Event) bool {
+	if len(processors) == 0 {
+		return true
+	}
+
+	*e = copyEvent(*e)
+	if e.Data == nil {
+		e.Data = make(map[string]interface{})
+	}
+
+	for _, process := range processors {
+		if !process(e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// StaticFields adds the fields to every event, e.g. hostname, service and
+// version. Fields already in the event are kept.
+func StaticFields(fields map[string]interface{}) Processor {
+	return func(e *Event) bool {
+		for k, v := range fields {
+			if _, ok := e.Data[k]; !ok {
+				e.Data[k] = v
+			}
+		}
+		return true
+	}
+}
+
+// RedactFields replaces the values of the fields with Redacted, also in
+// nested maps such as the captured query and request_headers
+func RedactFields(fields ...string) Processor {
+	redact := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		redact[field] = true
+	}
+
+	return func(e *Event) bool {
+		redactFields(e.Data, redact)
+		return true
+	}
+}
+
+// redactFields replaces the values of the fields in v and the maps and slices in it.
+// The event data is a deep copy, so nested values are changed in place.
+func redactFields(v interface{}, fields map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if fields[k] {
+				v[k] = Redacted
+			} else {
+				redactFields(item, fields)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			redactFields(item, fields)
+		}
+	case map[string]string:
+		for k := range v {
+			if fields[k] {
+				v[k] = Redacted
+			}
+		}
+	}
+}
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// RedactEmails replaces email addresses in string values with Redacted, also
+// in nested maps and slices
+func RedactEmails() Processor {
+	return func(e *Event) bool {
+		for k, v := range e.Data {
+			e.Data[k] = redactEmails(v)
+		}
+		return true
+	}
+}
+
+// redactEmails returns v with the email addresses in its strings replaced
+func redactEmails(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if emailPattern.MatchString(v) {
+			return emailPattern.ReplaceAllString(v, Redacted)
+		}
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = redactEmails(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactEmails(item)
+		}
+	case map[string]string:
+		for k, item := range v {
+			v[k] = redactEmails(item).(string)
+		}
+	case []string:
+		for i, item := range v {
+			v[i] = redactEmails(item).(string)
+		}
+	}
+	return v
+}
+
+// RenameKeys renames event keys, e.g. legacy keys to their new names
+func RenameKeys(renames map[string]string) Processor {
+	return func(e *Event) bool {
+		if key, ok := renames[e.Key]; ok {
+			e.Key = key
+		}
+		return true
+	}
+}
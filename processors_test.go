@@ -0,0 +1,93 @@
+package tlytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoggerProcessors(t *testing.T) {
+	store := NewMemoryStore()
+	dropDebug := func(e *Event) bool {
+		return e.Key != "debug"
+	}
+	logger := NewLogger(store, time.Hour,
+		RenameKeys(map[string]string{"signed_up": "signup"}),
+		dropDebug,
+		StaticFields(map[string]interface{}{"service": "api", "version": "1.2.0"}),
+		RedactFields("password"),
+		RedactEmails(),
+	)
+	defer logger.Stop()
+
+	data := map[string]interface{}{
+		"password": "hunter2",
+		"note":     "contact jane.doe@example.com for access",
+		"version":  "explicit",
+	}
+	logger.Emit(Event{Key: "signed_up", Data: data})
+	logger.Emit(Event{Key: "debug"})
+	logger.Emit(Event{Key: "pageview"})
+	logger.Flush()
+
+	// The caller's map is not changed
+	if data["password"] != "hunter2" {
+		t.Errorf("Expected the caller's data to be unchanged, got %v", data["password"])
+	}
+
+	events, err := store.QueryEvents(Query{Key: "signup"})
+	if err != nil {
+		t.Fatalf("Failed to query events: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 renamed signup event, got %d", len(events))
+	}
+
+	got := events[0].Data
+	if got["password"] != Redacted {
+		t.Errorf("Expected the password to be redacted, got %v", got["password"])
+	}
+	if got["note"] != "contact "+Redacted+" for access" {
+		t.Errorf("Expected the email to be scrubbed, got %v", got["note"])
+	}
+	if got["service"] != "api" || got["version"] != "explicit" {
+		t.Errorf("Expected static fields not to override event data, got %v", got)
+	}
+
+	count, err := store.CountEvents(Query{})
+	if err != nil {
+		t.Fatalf("Failed to count events: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected the debug event to be dropped, got %d events", count)
+	}
+}
+
+func TestRedactNestedData(t *testing.T) {
+	query := map[string]interface{}{"email": "jane.doe@example.com", "page": "2"}
+	headers := map[string]interface{}{"Authorization": "Bearer secret", "X-Forwarded-For": "192.0.2.1"}
+	event := Event{Key: "http_request", Data: map[string]interface{}{
+		"query":           query,
+		"request_headers": headers,
+		"recipients":      []interface{}{"bob@example.com", map[string]interface{}{"token": "abc"}},
+	}}
+
+	if !applyProcessors([]Processor{RedactFields("Authorization", "token"), RedactEmails()}, &event) {
+		t.Fatal("Expected the event to be kept")
+	}
+
+	if got := event.Data["query"].(map[string]interface{}); got["email"] != Redacted || got["page"] != "2" {
+		t.Errorf("Expected the email in the query to be redacted, got %v", got)
+	}
+	if got := event.Data["request_headers"].(map[string]interface{}); got["Authorization"] != Redacted || got["X-Forwarded-For"] != "192.0.2.1" {
+		t.Errorf("Expected the Authorization header to be redacted, got %v", got)
+	}
+	recipients := event.Data["recipients"].([]interface{})
+	if recipients[0] != Redacted || recipients[1].(map[string]interface{})["token"] != Redacted {
+		t.Errorf("Expected values in slices to be redacted, got %v", recipients)
+	}
+
+	// The caller's nested maps are not changed
+	if query["email"] != "jane.doe@example.com" || headers["Authorization"] != "Bearer secret" {
+		t.Errorf("Expected the caller's nested data to be unchanged, got %v and %v", query, headers)
+	}
+}
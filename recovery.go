@@ -0,0 +1,123 @@
+package tlytics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GinRecovery recovers from panics in handlers, emits an http_panic event
+// and responds with 500. Use it instead of gin.Recovery.
+func GinRecovery(analytics Emitter) gin.HandlerFunc {
+	return ginPanicHandler(analytics, false)
+}
+
+// GinPanicTracker emits an http_panic event and re-panics, so that
+// gin.Recovery or another recovery middleware handles the panic
+func GinPanicTracker(analytics Emitter) gin.HandlerFunc {
+	return ginPanicHandler(analytics, true)
+}
+
+func ginPanicHandler(analytics Emitter, repanic bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+
+			route := c.FullPath()
+			if route == "" {
+				route = UnmatchedRoute
+			}
+
+			stack := recordPanicStack(c)
+
+			data := map[string]interface{}{
+				"method":     c.Request.Method,
+				"route":      route,
+				"path":       c.Request.URL.Path,
+				"panic":      fmt.Sprint(err),
+				"stack_hash": stack.hash,
+				"location":   stack.location,
+				"client_ip":  c.ClientIP(),
+			}
+
+			if corr, ok := GetCorrelation(c); ok {
+				corr.addTo(data)
+			}
+
+			analytics.Emit(Event{
+				Key:       "http_panic",
+				Timestamp: time.Now(),
+				Data:      data,
+			})
+
+			if repanic {
+				panic(err)
+			}
+
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}()
+
+		c.Next()
+	}
+}
+
+// panicStackKey is the gin context key of the panicStack of a panic in a handler
+const panicStackKey = "tlytics_panic_stack"
+
+// panicStack identifies where a panic happened
+type panicStack struct {
+	hash     string
+	location string
+}
+
+// recordPanicStack returns the stack of the panic recovered by the calling
+// deferred function and stores it in the context. Middlewares that re-panic
+// put their own frames on the stack, so the stack recorded by the first
+// recovering middleware is returned if there is one.
+func recordPanicStack(c *gin.Context) panicStack {
+	if v, ok := c.Get(panicStackKey); ok {
+		return v.(panicStack)
+	}
+
+	// Skip runtime.Callers, stackHash, this function, the deferred function and gopanic
+	var stack panicStack
+	stack.hash, stack.location = stackHash(5)
+	c.Set(panicStackKey, stack)
+	return stack
+}
+
+// stackHash returns a hash of the function names and lines on the stack,
+// which is the same for every panic from the same place, and the first
+// frame outside the runtime
+func stackHash(skip int) (string, string) {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	h := sha256.New()
+	location := ""
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			line := fmt.Sprintf("%s:%d", frame.Function, frame.Line)
+			fmt.Fprintln(h, line)
+			if location == "" {
+				location = line
+			}
+		}
+		if !more {
+			break
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16], location
+}
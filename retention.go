@@ -0,0 +1,229 @@
+package tlytics
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Cohort granularities
+const (
+	GranularityDay   = "day"
+	GranularityWeek  = "week"
+	GranularityMonth = "month"
+)
+
+// DefaultRetentionPeriods is how many periods after the cohort's are counted if not set
+const DefaultRetentionPeriods = 8
+
+// DefaultMaxRetentionEvents is the most events ComputeRetention loads if not configured
+const DefaultMaxRetentionEvents = 1000000
+
+// Retention defines a cohort retention analysis. Visitors are grouped into
+// cohorts by the period of their first CohortKey event, and counted as
+// retained in each later period with a ReturnKey event.
+type Retention struct {
+	CohortKey     string
+	ReturnKey     string
+	IdentityField string    // Data field identifying the visitor, a hash of client_ip and user_agent if empty
+	Granularity   string    // GranularityDay, GranularityWeek (default, starting Monday) or GranularityMonth
+	Periods       int       // Periods after the cohort's to count, DefaultRetentionPeriods if 0
+	From          time.Time // First cohort events at or after this time, required
+	To            time.Time // First cohort events before this time, required
+	MaxEvents     int       // Most cohort and return events loaded, DefaultMaxRetentionEvents if 0
+}
+
+// Cohort is one row of the retention matrix. Retained[i] and Rates[i] are
+// for the (i+1)th period after the cohort's, for the periods started so far.
+type Cohort struct {
+	Start    time.Time `json:"start"`
+	Size     int       `json:"size"`
+	Retained []int     `json:"retained"`
+	Rates    []float64 `json:"rates"`
+}
+
+// RetentionResult is the retention matrix, one cohort per period, oldest first
+type RetentionResult struct {
+	Granularity string   `json:"granularity"`
+	Periods     int      `json:"periods"`
+	Cohorts     []Cohort `json:"cohorts"`
+}
+
+// validGranularity reports whether periodStart supports the granularity
+func validGranularity(granularity string) bool {
+	switch granularity {
+	case GranularityDay, GranularityWeek, GranularityMonth:
+		return true
+	}
+	return false
+}
+
+// periodStart returns the start of the UTC period containing t
+func periodStart(t time.Time, granularity string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch granularity {
+	case GranularityDay:
+		return day
+	case GranularityMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		// Weeks start on Monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+}
+
+// addPeriods returns the start of the nth period after the one starting at start
+func addPeriods(start time.Time, n int, granularity string) time.Time {
+	switch granularity {
+	case GranularityDay:
+		return start.AddDate(0, 0, n)
+	case GranularityMonth:
+		return start.AddDate(0, n, 0)
+	default:
+		return start.AddDate(0, 0, 7*n)
+	}
+}
+
+// periodsBetween returns how many periods the period starting at to is after the one starting at from
+func periodsBetween(from, to time.Time, granularity string) int {
+	switch granularity {
+	case GranularityDay:
+		return int(to.Sub(from).Hours() / 24)
+	case GranularityMonth:
+		return (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month())
+	default:
+		return int(to.Sub(from).Hours() / (24 * 7))
+	}
+}
+
+// ComputeRetention returns the retention matrix. It returns ErrTooManyEvents
+// if the cohort and return events are more than MaxEvents.
+func ComputeRetention(store Store, r Retention) (RetentionResult, error) {
+	if r.From.IsZero() || r.To.IsZero() {
+		return RetentionResult{}, fmt.Errorf("retention needs a time range")
+	}
+	if r.Granularity == "" {
+		r.Granularity = GranularityWeek
+	}
+	if !validGranularity(r.Granularity) {
+		return RetentionResult{}, fmt.Errorf("invalid granularity: %s", r.Granularity)
+	}
+	if r.Periods <= 0 {
+		r.Periods = DefaultRetentionPeriods
+	}
+	remaining := r.MaxEvents
+	if remaining <= 0 {
+		remaining = DefaultMaxRetentionEvents
+	}
+
+	cohortEvents, err := queryEventsMax(store, Query{Key: r.CohortKey, From: r.From, To: r.To}, remaining)
+	if err != nil {
+		return RetentionResult{}, err
+	}
+	remaining -= len(cohortEvents)
+
+	// Each visitor belongs to the cohort of their first event
+	first := make(map[string]time.Time)
+	for _, e := range cohortEvents {
+		identity := identityOf(e, r.IdentityField)
+		if identity == "" {
+			continue
+		}
+		if t, ok := first[identity]; !ok || e.Timestamp.Before(t) {
+			first[identity] = e.Timestamp
+		}
+	}
+
+	result := RetentionResult{
+		Granularity: r.Granularity,
+		Periods:     r.Periods,
+		Cohorts:     make([]Cohort, 0),
+	}
+	if len(first) == 0 {
+		return result, nil
+	}
+
+	cohortOf := make(map[string]time.Time, len(first))
+	sizes := make(map[time.Time]int)
+	var earliest, latest time.Time
+	for identity, t := range first {
+		start := periodStart(t, r.Granularity)
+		cohortOf[identity] = start
+		sizes[start]++
+		if earliest.IsZero() || start.Before(earliest) {
+			earliest = start
+		}
+		if start.After(latest) {
+			latest = start
+		}
+	}
+
+	returnEvents, err := queryEventsMax(store, Query{
+		Key:  r.ReturnKey,
+		From: addPeriods(earliest, 1, r.Granularity),
+		To:   addPeriods(latest, r.Periods+1, r.Granularity),
+	}, remaining)
+	if err != nil {
+		return RetentionResult{}, err
+	}
+
+	// Count each visitor once per period
+	type visit struct {
+		identity string
+		period   int
+	}
+	seen := make(map[visit]bool)
+	retained := make(map[time.Time][]int)
+	for _, e := range returnEvents {
+		identity := identityOf(e, r.IdentityField)
+		start, ok := cohortOf[identity]
+		if !ok {
+			continue
+		}
+
+		period := periodsBetween(start, periodStart(e.Timestamp, r.Granularity), r.Granularity)
+		if period < 1 || period > r.Periods || seen[visit{identity, period}] {
+			continue
+		}
+		seen[visit{identity, period}] = true
+
+		if retained[start] == nil {
+			retained[start] = make([]int, r.Periods)
+		}
+		retained[start][period-1]++
+	}
+
+	now := time.Now()
+	for start, size := range sizes {
+		// Only periods that have started
+		elapsed := periodsBetween(start, periodStart(now, r.Granularity), r.Granularity)
+		if elapsed > r.Periods {
+			elapsed = r.Periods
+		}
+		if elapsed < 0 {
+			elapsed = 0
+		}
+
+		cohort := Cohort{
+			Start:    start,
+			Size:     size,
+			Retained: make([]int, elapsed),
+			Rates:    make([]float64, elapsed),
+		}
+		for i := 0; i < elapsed; i++ {
+			if counts := retained[start]; counts != nil {
+				cohort.Retained[i] = counts[i]
+			}
+			cohort.Rates[i] = float64(cohort.Retained[i]) / float64(size)
+		}
+		result.Cohorts = append(result.Cohorts, cohort)
+	}
+
+	sort.Slice(result.Cohorts, func(i, j int) bool {
+		return result.Cohorts[i].Start.Before(result.Cohorts[j].Start)
+	})
+
+	return result, nil
+}
@@ -0,0 +1,119 @@
+package tlytics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRetentionEndpoint(t *testing.T) {
+	day := func(d int, key, user string) Event {
+		return Event{
+			Key:       key,
+			Timestamp: time.Date(2025, 8, d, 12, 0, 0, 0, time.UTC),
+			Data:      map[string]interface{}{"user_id": user},
+		}
+	}
+
+	store := NewMemoryStore()
+	store.InsertEvents([]Event{
+		// Week of Monday August 4
+		day(4, "signup", "u1"),
+		day(6, "signup", "u2"),
+		day(7, "page_view", "u2"), // Same week, not a return
+		// Week of August 11
+		day(11, "signup", "u1"), // u1 stays in the first cohort
+		day(12, "page_view", "u1"),
+		day(13, "page_view", "u1"),
+		day(14, "signup", "u3"),
+		// Week of August 18
+		day(19, "page_view", "u3"),
+		day(20, "page_view", "u1"),
+		day(20, "page_view", "nobody"),
+	})
+
+	gin.SetMode(gin.TestMode)
+	server := newHTTPServer(nil, store, 0)
+
+	req := httptest.NewRequest("GET", "/analysis/retention?cohort_key=signup&return_key=page_view&identity=user_id&periods=3&from=2025-08-01T00:00:00Z&to=2025-09-01T00:00:00Z", nil)
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var result RetentionResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	expected := []Cohort{
+		{
+			Start:    time.Date(2025, 8, 4, 0, 0, 0, 0, time.UTC),
+			Size:     2,
+			Retained: []int{1, 1, 0},
+			Rates:    []float64{0.5, 0.5, 0},
+		},
+		{
+			Start:    time.Date(2025, 8, 11, 0, 0, 0, 0, time.UTC),
+			Size:     1,
+			Retained: []int{1, 0, 0},
+			Rates:    []float64{1, 0, 0},
+		},
+	}
+	if result.Granularity != GranularityWeek || !reflect.DeepEqual(result.Cohorts, expected) {
+		t.Errorf("Expected cohorts %+v, got %+v", expected, result)
+	}
+
+	req = httptest.NewRequest("GET", "/analysis/retention?cohort_key=signup&return_key=page_view&granularity=year&from=2025-08-01T00:00:00Z&to=2025-09-01T00:00:00Z", nil)
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid granularity, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/analysis/retention?cohort_key=signup&return_key=page_view&from=2025-08-01T00:00:00Z", nil)
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a time range, got %d", w.Code)
+	}
+
+	// 4 signups and 5 page views in the return periods
+	r := Retention{
+		CohortKey:     "signup",
+		ReturnKey:     "page_view",
+		IdentityField: "user_id",
+		Periods:       3,
+		From:          time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC),
+		To:            time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC),
+		MaxEvents:     8,
+	}
+	if _, err := ComputeRetention(store, r); err != ErrTooManyEvents {
+		t.Errorf("Expected ErrTooManyEvents, got %v", err)
+	}
+	r.MaxEvents = 9
+	if _, err := ComputeRetention(store, r); err != nil {
+		t.Errorf("Expected the retention to fit in 9 events, got %v", err)
+	}
+}
+
+func TestPeriodStart(t *testing.T) {
+	sunday := time.Date(2025, 8, 31, 23, 0, 0, 0, time.UTC)
+
+	if got := periodStart(sunday, GranularityWeek); !got.Equal(time.Date(2025, 8, 25, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the week to start on Monday August 25, got %s", got)
+	}
+	if got := periodStart(sunday, GranularityMonth); !got.Equal(time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected August 1, got %s", got)
+	}
+	if n := periodsBetween(time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), GranularityMonth); n != 3 {
+		t.Errorf("Expected 3 months, got %d", n)
+	}
+}
@@ -1,35 +1,63 @@
 package tlytics
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type Server struct {
-	logger *Logger
-	port   int
+	logger     *Logger
+	store      Store
+	port       int
+	adminToken string
+	backups    *backupManager
+	sessions   SessionConfig
+
+	erasureSecret []byte
 }
 
-func newHTTPServer(logger *Logger, port int) *Server {
+func newHTTPServer(logger *Logger, store Store, port int) *Server {
 	return &Server{
 		logger: logger,
+		store:  store,
 		port:   port,
 	}
 }
 
 func (s *Server) Start() error {
+	return s.router().Run(fmt.Sprintf(":%d", s.port))
+}
+
+// router returns the engine with the server's routes
+func (s *Server) router() *gin.Engine {
 	r := gin.Default()
 	
 	r.POST("/events", s.handleEvents)
 	r.POST("/batch", s.handleBatch)
 	r.GET("/health", s.handleHealth)
 	r.GET("/view", s.handleView)
+	r.GET("/stats", s.handleStats)
+	r.GET("/sessions", s.handleSessions)
+	r.POST("/analysis/funnel", s.handleFunnel)
+	r.GET("/analysis/retention", s.handleRetention)
+	r.GET("/analysis/breakdown", s.handleBreakdown)
+	
+	admin := r.Group("/admin", s.requireAdmin)
+	admin.POST("/backup", s.handleBackup)
+	admin.GET("/subjects", s.handleFindSubject)
+	admin.GET("/subjects/export", s.handleExportSubject)
+	admin.DELETE("/subjects", s.handleEraseSubject)
+	admin.GET("/erasures", s.handleErasures)
 	
-	return r.Run(fmt.Sprintf(":%d", s.port))
+	return r
 }
 
 func (s *Server) handleEvents(c *gin.Context) {
@@ -46,6 +74,13 @@ func (s *Server) handleEvents(c *gin.Context) {
 			return
 		}
 		
+		if err := s.logger.checkPolicy(event); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	
+	for _, event := range events {
 		if err := s.logger.Emit(event); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to emit event"})
 			return
@@ -91,6 +126,11 @@ func (s *Server) handleBatch(c *gin.Context) {
 			return
 		}
 		
+		if err := s.logger.checkPolicy(event); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		
 		events = append(events, event)
 	}
 	
@@ -133,8 +173,25 @@ func (s *Server) handleView(c *gin.Context) {
 	// Calculate offset
 	offset := (page - 1) * pageSize
 	
-	// Get events from database
-	events, total, err := s.logger.db.GetEvents(pageSize, offset)
+	q, err := parseQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
+	// Get events from the store
+	var events []Event
+	var total int
+	if q != (Query{}) {
+		q.Limit = pageSize
+		q.Offset = offset
+		events, err = s.store.QueryEvents(q)
+		if err == nil {
+			total, err = s.store.CountEvents(q)
+		}
+	} else {
+		events, total, err = s.store.GetEvents(pageSize, offset)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve events"})
 		return
@@ -152,4 +209,422 @@ func (s *Server) handleView(c *gin.Context) {
 	}
 	
 	c.JSON(http.StatusOK, response)
-}
\ No newline at end of file
+}
+
+type StatsResponse struct {
+	Buckets        []AggregateBucket            `json:"buckets"`
+	Interval       string                       `json:"interval"`
+	DistinctTotals map[string]map[string]uint64 `json:"distinct_totals,omitempty"`
+}
+
+func (s *Server) handleStats(c *gin.Context) {
+	q, err := parseQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
+	interval, err := time.ParseDuration(c.DefaultQuery("interval", "1h"))
+	if err != nil || interval < time.Second {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval"})
+		return
+	}
+	
+	buckets, err := s.store.Aggregate(q, interval)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to aggregate events"})
+		return
+	}
+	
+	response := StatsResponse{
+		Buckets:  buckets,
+		Interval: interval.String(),
+	}
+	
+	if distinct := c.Query("distinct"); distinct != "" {
+		sketches, ok := s.store.(SketchStore)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Distinct counts are not supported by the storage backend"})
+			return
+		}
+		if interval%SketchInterval != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Interval must be a multiple of 1h for distinct counts"})
+			return
+		}
+		if q.ExcludeBots || q.Field != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Distinct counts cannot be combined with exclude_bots or filter_field"})
+			return
+		}
+		if !sketchAligned(q.From) || !sketchAligned(q.To) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "From and to must be on the hour for distinct counts"})
+			return
+		}
+		
+		counts, err := CountDistinct(sketches, q, interval, strings.Split(distinct, ","))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count distinct values"})
+			return
+		}
+		
+		response.Buckets = addDistinct(response.Buckets, counts)
+		response.DistinctTotals = counts.Totals
+	}
+	
+	c.JSON(http.StatusOK, response)
+}
+
+type SessionsResponse struct {
+	Metrics  SessionMetrics `json:"metrics"`
+	Sessions []Session      `json:"sessions,omitempty"`
+}
+
+func (s *Server) handleSessions(c *gin.Context) {
+	q, err := parseQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
+	config := s.sessions
+	if identity := c.Query("identity"); identity != "" {
+		config.IdentityField = identity
+	}
+	if timeout := c.Query("timeout"); timeout != "" {
+		config.Timeout, err = time.ParseDuration(timeout)
+		if err != nil || config.Timeout <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timeout"})
+			return
+		}
+	}
+	
+	if q.From.IsZero() || q.To.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "From and to are required"})
+		return
+	}
+	
+	sessions, err := SessionizeStore(s.store, q, config)
+	if errors.Is(err, ErrTooManyEvents) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many events, narrow the time range"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute sessions"})
+		return
+	}
+	
+	response := SessionsResponse{Metrics: ComputeSessionMetrics(sessions)}
+	if c.Query("sessions") == "true" {
+		response.Sessions = sessions
+	}
+	
+	c.JSON(http.StatusOK, response)
+}
+
+type FunnelRequest struct {
+	Steps    []FunnelStep `json:"steps"`
+	Identity string       `json:"identity"`
+	Window   string       `json:"window"`
+	From     time.Time    `json:"from"`
+	To       time.Time    `json:"to"`
+}
+
+func (s *Server) handleFunnel(c *gin.Context) {
+	var req FunnelRequest
+	
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+		return
+	}
+	
+	if len(req.Steps) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one step is required"})
+		return
+	}
+	for _, step := range req.Steps {
+		if step.Key == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Step key is required"})
+			return
+		}
+	}
+	
+	if req.From.IsZero() || req.To.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "From and to are required"})
+		return
+	}
+	
+	funnel := Funnel{
+		Steps:         req.Steps,
+		IdentityField: req.Identity,
+		From:          req.From,
+		To:            req.To,
+	}
+	if req.Window != "" {
+		window, err := time.ParseDuration(req.Window)
+		if err != nil || window <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid window"})
+			return
+		}
+		funnel.Window = window
+	}
+	
+	result, err := ComputeFunnel(s.store, funnel)
+	if errors.Is(err, ErrTooManyEvents) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many events, narrow the time range"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute funnel"})
+		return
+	}
+	
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) handleRetention(c *gin.Context) {
+	q, err := parseQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
+	r := Retention{
+		CohortKey:     c.Query("cohort_key"),
+		ReturnKey:     c.Query("return_key"),
+		IdentityField: c.Query("identity"),
+		Granularity:   c.DefaultQuery("granularity", GranularityWeek),
+		From:          q.From,
+		To:            q.To,
+	}
+	
+	if r.CohortKey == "" || r.ReturnKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cohort and return keys are required"})
+		return
+	}
+	if r.From.IsZero() || r.To.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "From and to are required"})
+		return
+	}
+	if !validGranularity(r.Granularity) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid granularity"})
+		return
+	}
+	if periods := c.Query("periods"); periods != "" {
+		r.Periods, err = strconv.Atoi(periods)
+		if err != nil || r.Periods < 1 || r.Periods > 366 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid periods"})
+			return
+		}
+	}
+	
+	result, err := ComputeRetention(s.store, r)
+	if errors.Is(err, ErrTooManyEvents) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many events, narrow the time range"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute retention"})
+		return
+	}
+	
+	c.JSON(http.StatusOK, result)
+}
+
+type BreakdownResponse struct {
+	Groups []BreakdownGroup `json:"groups"`
+}
+
+func (s *Server) handleBreakdown(c *gin.Context) {
+	q, err := parseQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
+	if q.Key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Key is required"})
+		return
+	}
+	if c.Query("by") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one field to group by is required"})
+		return
+	}
+	
+	b := Breakdown{
+		Fields:  strings.Split(c.Query("by"), ","),
+		Sum:     c.Query("sum"),
+		OrderBy: c.DefaultQuery("order", OrderByCount),
+	}
+	if err := b.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	
+	q.Limit = DefaultBreakdownLimit
+	if limit := c.Query("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 1 || q.Limit > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+	}
+	
+	groups, err := s.store.Breakdown(q, b)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to break down events"})
+		return
+	}
+	
+	c.JSON(http.StatusOK, BreakdownResponse{Groups: groups})
+}
+
+// parseQuery reads the key, from, to, exclude_bots and filter_field and
+// filter_value filters from the request query string. from and to are RFC 3339
+// timestamps.
+func parseQuery(c *gin.Context) (Query, error) {
+	q := Query{Key: c.Query("key")}
+	
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return q, fmt.Errorf("invalid from timestamp: %s", from)
+		}
+		q.From = t
+	}
+	
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return q, fmt.Errorf("invalid to timestamp: %s", to)
+		}
+		q.To = t
+	}
+	
+	q.ExcludeBots = c.Query("exclude_bots") == "true"
+	q.Field = c.Query("filter_field")
+	q.Value = c.Query("filter_value")
+	
+	return q, nil
+}
+
+// requireAdmin checks the bearer token on /admin endpoints. Without an
+// AdminToken the endpoints are disabled, they export and erase personal data.
+func (s *Server) requireAdmin(c *gin.Context) {
+	if s.adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin endpoints are disabled, no admin token is configured"})
+		return
+	}
+	
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+	}
+}
+
+func (s *Server) handleBackup(c *gin.Context) {
+	if s.backups == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Backups are not configured"})
+		return
+	}
+	
+	path, err := s.backups.run()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create backup"})
+		return
+	}
+	
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Backup created",
+		"path":    path,
+	})
+}
+
+// subjectParams reads the field and value identifying a data subject
+func (s *Server) subjectParams(c *gin.Context) (string, string, bool) {
+	field, value := c.Query("field"), c.Query("value")
+	if field == "" || value == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Field and value are required"})
+		return "", "", false
+	}
+	
+	// Queued events of the subject must be stored before they are looked up
+	s.logger.Flush()
+	
+	return field, value, true
+}
+
+func (s *Server) handleFindSubject(c *gin.Context) {
+	field, value, ok := s.subjectParams(c)
+	if !ok {
+		return
+	}
+	
+	count, err := FindSubject(s.store, field, value)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find events"})
+		return
+	}
+	
+	c.JSON(http.StatusOK, gin.H{
+		"field": field,
+		"count": count,
+	})
+}
+
+func (s *Server) handleExportSubject(c *gin.Context) {
+	field, value, ok := s.subjectParams(c)
+	if !ok {
+		return
+	}
+	
+	events, err := ExportSubject(s.store, field, value)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export events"})
+		return
+	}
+	
+	c.JSON(http.StatusOK, gin.H{
+		"field":  field,
+		"value":  value,
+		"events": events,
+		"count":  len(events),
+	})
+}
+
+func (s *Server) handleEraseSubject(c *gin.Context) {
+	field, value, ok := s.subjectParams(c)
+	if !ok {
+		return
+	}
+	
+	if len(s.erasureSecret) == 0 {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Erasure secret is not configured"})
+		return
+	}
+	
+	record, err := EraseSubject(s.store, s.erasureSecret, field, value)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":  "Failed to erase events",
+			"record": record,
+		})
+		return
+	}
+	
+	c.JSON(http.StatusOK, record)
+}
+
+func (s *Server) handleErasures(c *gin.Context) {
+	erasures, ok := s.store.(ErasureStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Storage backend does not support erasure records"})
+		return
+	}
+	
+	records, err := erasures.Erasures()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve erasures"})
+		return
+	}
+	
+	c.JSON(http.StatusOK, gin.H{"erasures": records})
+}
@@ -0,0 +1,315 @@
+package tlytics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultSessionTimeout is the inactivity that ends a session if not configured
+const DefaultSessionTimeout = 30 * time.Minute
+
+// DefaultMaxSessionEvents is the most events SessionizeStore loads if not configured
+const DefaultMaxSessionEvents = 1000000
+
+// ErrTooManyEvents is returned when an analysis matches more events than it
+// loads into memory, a narrower time range may fit
+var ErrTooManyEvents = errors.New("too many events, narrow the time range")
+
+// SessionConfig defines how events are grouped into sessions
+type SessionConfig struct {
+	IdentityField string        // Data field identifying the visitor, e.g. user_id. Empty uses a hash of client_ip and user_agent.
+	Timeout       time.Duration // Inactivity that ends a session, DefaultSessionTimeout if 0
+	PathField     string        // Data field with the page for entry and exit paths, path (falling back to route) if empty
+	MaxEvents     int           // Most events loaded by SessionizeStore, DefaultMaxSessionEvents if 0
+}
+
+// Session is a run of events of one visitor without a gap longer than the timeout
+type Session struct {
+	ID        string    `json:"id"`
+	Identity  string    `json:"identity"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Events    int       `json:"events"`
+	EntryPath string    `json:"entry_path,omitempty"`
+	ExitPath  string    `json:"exit_path,omitempty"`
+}
+
+// PathCount is the number of sessions entering or leaving at a path
+type PathCount struct {
+	Path     string `json:"path"`
+	Sessions int    `json:"sessions"`
+}
+
+// SessionMetrics summarizes sessions
+type SessionMetrics struct {
+	Sessions           int         `json:"sessions"`
+	AvgDurationSeconds float64     `json:"avg_duration_seconds"`
+	AvgEvents          float64     `json:"avg_events_per_session"`
+	EntryPaths         []PathCount `json:"entry_paths"`
+	ExitPaths          []PathCount `json:"exit_paths"`
+}
+
+// maxSessionPaths limits the entry and exit paths in SessionMetrics
+const maxSessionPaths = 10
+
+// identityOf returns the value of the identity field as text, or a hash of
+// client_ip and user_agent if field is empty. It returns "" for events
+// without an identity.
+func identityOf(e Event, field string) string {
+	if field != "" {
+		v, ok := e.Data[field]
+		if !ok || v == nil {
+			return ""
+		}
+		return fmt.Sprint(v)
+	}
+
+	ip, _ := e.Data["client_ip"].(string)
+	if ip == "" {
+		return ""
+	}
+	ua, _ := e.Data["user_agent"].(string)
+
+	hash := sha256.Sum256([]byte(ip + "\x00" + ua))
+	return hex.EncodeToString(hash[:8])
+}
+
+func (c SessionConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultSessionTimeout
+	}
+	return c.Timeout
+}
+
+func (c SessionConfig) maxEvents() int {
+	if c.MaxEvents <= 0 {
+		return DefaultMaxSessionEvents
+	}
+	return c.MaxEvents
+}
+
+func (c SessionConfig) path(e Event) string {
+	field := c.PathField
+	if field == "" {
+		if path, ok := e.Data["path"].(string); ok {
+			return path
+		}
+		field = "route"
+	}
+	path, _ := e.Data[field].(string)
+	return path
+}
+
+// sessionID is derived from the identity and start, so sessionizing the same
+// events again gives the same IDs
+func sessionID(identity string, start time.Time) string {
+	hash := sha256.Sum256([]byte(identity + "\x00" + start.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Sessionize groups the events into sessions, ordered by start. Events
+// without an identity are skipped.
+func Sessionize(events []Event, config SessionConfig) []Session {
+	byIdentity := make(map[string][]Event)
+	for _, e := range events {
+		if identity := identityOf(e, config.IdentityField); identity != "" {
+			byIdentity[identity] = append(byIdentity[identity], e)
+		}
+	}
+
+	timeout := config.timeout()
+	sessions := make([]Session, 0)
+	for identity, visits := range byIdentity {
+		sort.SliceStable(visits, func(i, j int) bool {
+			return visits[i].Timestamp.Before(visits[j].Timestamp)
+		})
+
+		var current *Session
+		for _, e := range visits {
+			if current != nil && e.Timestamp.Sub(current.End) > timeout {
+				sessions = append(sessions, *current)
+				current = nil
+			}
+			if current == nil {
+				current = &Session{
+					ID:        sessionID(identity, e.Timestamp),
+					Identity:  identity,
+					Start:     e.Timestamp,
+					EntryPath: config.path(e),
+				}
+			}
+
+			current.End = e.Timestamp
+			current.Events++
+			if path := config.path(e); path != "" {
+				current.ExitPath = path
+				if current.EntryPath == "" {
+					current.EntryPath = path
+				}
+			}
+		}
+		sessions = append(sessions, *current)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].Start.Equal(sessions[j].Start) {
+			return sessions[i].Start.Before(sessions[j].Start)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+
+	return sessions
+}
+
+// ComputeSessionMetrics returns the session count, average duration and
+// events per session and the most common entry and exit paths
+func ComputeSessionMetrics(sessions []Session) SessionMetrics {
+	metrics := SessionMetrics{
+		Sessions:   len(sessions),
+		EntryPaths: make([]PathCount, 0),
+		ExitPaths:  make([]PathCount, 0),
+	}
+	if len(sessions) == 0 {
+		return metrics
+	}
+
+	var duration time.Duration
+	events := 0
+	entries := make(map[string]int)
+	exits := make(map[string]int)
+	for _, s := range sessions {
+		duration += s.End.Sub(s.Start)
+		events += s.Events
+		if s.EntryPath != "" {
+			entries[s.EntryPath]++
+		}
+		if s.ExitPath != "" {
+			exits[s.ExitPath]++
+		}
+	}
+
+	metrics.AvgDurationSeconds = duration.Seconds() / float64(len(sessions))
+	metrics.AvgEvents = float64(events) / float64(len(sessions))
+	metrics.EntryPaths = topPaths(entries)
+	metrics.ExitPaths = topPaths(exits)
+
+	return metrics
+}
+
+func topPaths(counts map[string]int) []PathCount {
+	paths := make([]PathCount, 0, len(counts))
+	for path, n := range counts {
+		paths = append(paths, PathCount{Path: path, Sessions: n})
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Sessions != paths[j].Sessions {
+			return paths[i].Sessions > paths[j].Sessions
+		}
+		return paths[i].Path < paths[j].Path
+	})
+
+	if len(paths) > maxSessionPaths {
+		paths = paths[:maxSessionPaths]
+	}
+	return paths
+}
+
+// SessionizeStore sessionizes the events matching the query, which needs a
+// time range. Sessions running at From are looked back for until a gap longer
+// than the timeout, so their start and ID don't depend on the range. Events
+// after To are not included. It returns ErrTooManyEvents if more than
+// MaxEvents events are loaded.
+func SessionizeStore(store Store, q Query, config SessionConfig) ([]Session, error) {
+	if q.From.IsZero() || q.To.IsZero() {
+		return nil, fmt.Errorf("sessions need a time range")
+	}
+	timeout := config.timeout()
+	max := config.maxEvents()
+
+	events, err := queryEventsMax(store, q, max)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk back one timeout at a time while a visitor's earliest event may
+	// continue an earlier session
+	boundary := q.From
+	for {
+		open := openIdentities(events, config.IdentityField, boundary, timeout)
+		if len(open) == 0 {
+			break
+		}
+
+		lookback := q
+		lookback.From, lookback.To = boundary.Add(-timeout), boundary
+		earlier, err := queryEventsMax(store, lookback, max-len(events))
+		if err != nil {
+			return nil, err
+		}
+
+		linked := 0
+		for _, e := range earlier {
+			if open[identityOf(e, config.IdentityField)] {
+				events = append(events, e)
+				linked++
+			}
+		}
+		if linked == 0 {
+			break
+		}
+		boundary = lookback.From
+	}
+
+	// Looked back events may form sessions ending before the range
+	sessions := Sessionize(events, config)
+	kept := sessions[:0]
+	for _, s := range sessions {
+		if !s.End.Before(q.From) {
+			kept = append(kept, s)
+		}
+	}
+
+	return kept, nil
+}
+
+// openIdentities returns the identities whose earliest event is at most the
+// timeout after boundary, so an earlier event may belong to the same session
+func openIdentities(events []Event, field string, boundary time.Time, timeout time.Duration) map[string]bool {
+	earliest := make(map[string]time.Time)
+	for _, e := range events {
+		identity := identityOf(e, field)
+		if identity == "" {
+			continue
+		}
+		if t, ok := earliest[identity]; !ok || e.Timestamp.Before(t) {
+			earliest[identity] = e.Timestamp
+		}
+	}
+
+	open := make(map[string]bool)
+	for identity, t := range earliest {
+		if t.Sub(boundary) <= timeout {
+			open[identity] = true
+		}
+	}
+	return open
+}
+
+// queryEventsMax returns the events matching the query, or ErrTooManyEvents
+// if there are more than max
+func queryEventsMax(store Store, q Query, max int) ([]Event, error) {
+	q.Limit, q.Offset = max+1, 0
+	events, err := store.QueryEvents(q)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	if len(events) > max {
+		return nil, ErrTooManyEvents
+	}
+	return events, nil
+}
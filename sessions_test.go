@@ -0,0 +1,170 @@
+package tlytics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func sessionTestEvents(base time.Time) []Event {
+	view := func(offset time.Duration, user, path string) Event {
+		return Event{
+			Key:       "page_view",
+			Timestamp: base.Add(offset),
+			Data:      map[string]interface{}{"user_id": user, "path": path},
+		}
+	}
+
+	return []Event{
+		// u1: two sessions split by a 45 minute gap
+		view(0, "u1", "/"),
+		view(5*time.Minute, "u1", "/pricing"),
+		view(10*time.Minute, "u1", "/signup"),
+		view(55*time.Minute, "u1", "/blog"),
+		// u2: one session
+		view(2*time.Minute, "u2", "/"),
+		view(22*time.Minute, "u2", "/docs"),
+		// No identity
+		{Key: "page_view", Timestamp: base, Data: map[string]interface{}{"path": "/"}},
+	}
+}
+
+func TestSessionize(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+	config := SessionConfig{IdentityField: "user_id"}
+
+	sessions := Sessionize(sessionTestEvents(base), config)
+	if len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %d", len(sessions))
+	}
+
+	first := sessions[0]
+	if first.Identity != "u1" || first.Events != 3 || first.EntryPath != "/" || first.ExitPath != "/signup" {
+		t.Errorf("Unexpected first session: %+v", first)
+	}
+	if first.End.Sub(first.Start) != 10*time.Minute {
+		t.Errorf("Expected a 10 minute session, got %s", first.End.Sub(first.Start))
+	}
+
+	// IDs are stable across runs
+	again := Sessionize(sessionTestEvents(base), config)
+	if again[0].ID != first.ID || first.ID == sessions[1].ID {
+		t.Error("Expected stable, distinct session IDs")
+	}
+
+	// A longer timeout joins u1's sessions
+	if n := len(Sessionize(sessionTestEvents(base), SessionConfig{IdentityField: "user_id", Timeout: time.Hour})); n != 2 {
+		t.Errorf("Expected 2 sessions with a 1h timeout, got %d", n)
+	}
+
+	metrics := ComputeSessionMetrics(sessions)
+	if metrics.Sessions != 3 {
+		t.Errorf("Expected 3 sessions, got %d", metrics.Sessions)
+	}
+	if metrics.AvgEvents != 2 {
+		t.Errorf("Expected 2 events per session, got %v", metrics.AvgEvents)
+	}
+	if metrics.AvgDurationSeconds != 600 {
+		t.Errorf("Expected an average of 600s, got %v", metrics.AvgDurationSeconds)
+	}
+	if len(metrics.EntryPaths) != 2 || metrics.EntryPaths[0] != (PathCount{Path: "/", Sessions: 2}) {
+		t.Errorf("Unexpected entry paths: %v", metrics.EntryPaths)
+	}
+}
+
+func TestSessionizeStoreLooksBack(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+	view := func(offset time.Duration, user string) Event {
+		return Event{Key: "page_view", Timestamp: base.Add(offset), Data: map[string]interface{}{"user_id": user}}
+	}
+
+	store := NewMemoryStore()
+	store.InsertEvents([]Event{
+		// u1: one session from 9:00 running past 10:00, linked by gaps under the timeout
+		view(-60*time.Minute, "u1"),
+		view(-35*time.Minute, "u1"),
+		view(-10*time.Minute, "u1"),
+		view(10*time.Minute, "u1"),
+		// u2: a session ending before 10:00, then one starting after it
+		view(-50*time.Minute, "u2"),
+		view(20*time.Minute, "u2"),
+	})
+
+	config := SessionConfig{IdentityField: "user_id"}
+	day := Query{From: base.Add(-10 * time.Hour), To: base.Add(10 * time.Hour)}
+	hour := Query{From: base, To: base.Add(time.Hour)}
+
+	all, err := SessionizeStore(store, day, config)
+	if err != nil {
+		t.Fatalf("Failed to sessionize: %v", err)
+	}
+	inRange, err := SessionizeStore(store, hour, config)
+	if err != nil {
+		t.Fatalf("Failed to sessionize: %v", err)
+	}
+
+	if len(all) != 3 || len(inRange) != 2 {
+		t.Fatalf("Expected 3 sessions in the day and 2 running in the hour, got %+v and %+v", all, inRange)
+	}
+
+	// The sessions running in the hour are the same as in the whole day
+	if inRange[0] != all[0] || inRange[1] != all[2] {
+		t.Errorf("Expected the sessions not to depend on the range, got %+v and %+v", inRange, all)
+	}
+	if !inRange[0].Start.Equal(base.Add(-60*time.Minute)) || inRange[0].Events != 4 {
+		t.Errorf("Expected u1's session to start at 9:00 with 4 events, got %+v", inRange[0])
+	}
+}
+
+func TestSessionsEndpoint(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	store.InsertEvents(sessionTestEvents(base))
+
+	gin.SetMode(gin.TestMode)
+	server := newHTTPServer(nil, store, 0)
+	server.sessions = SessionConfig{IdentityField: "user_id"}
+
+	req := httptest.NewRequest("GET", "/sessions?key=page_view&sessions=true&from=2025-08-25T00:00:00Z&to=2025-08-26T00:00:00Z", nil)
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response SessionsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Metrics.Sessions != 3 || len(response.Sessions) != 3 {
+		t.Errorf("Expected 3 sessions, got %+v", response)
+	}
+
+	req = httptest.NewRequest("GET", "/sessions?timeout=nope", nil)
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid timeout, got %d", w.Code)
+	}
+
+	// Sessions load all matching events, so the range is bounded and capped
+	req = httptest.NewRequest("GET", "/sessions?key=page_view&from=2025-08-25T00:00:00Z", nil)
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without to, got %d", w.Code)
+	}
+
+	server.sessions.MaxEvents = 2
+	req = httptest.NewRequest("GET", "/sessions?key=page_view&from=2025-08-25T00:00:00Z&to=2025-08-26T00:00:00Z", nil)
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for more than MaxEvents events, got %d", w.Code)
+	}
+}
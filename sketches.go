@@ -0,0 +1,200 @@
+package tlytics
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SketchInterval is the time bucket of persisted distinct count sketches.
+// Distinct counts are available for multiples of it.
+const SketchInterval = time.Hour
+
+// Sketch holds the distinct values of a data field in the events of a key in one SketchInterval
+type Sketch struct {
+	Key   string
+	Field string
+	Start time.Time
+	HLL   *HyperLogLog
+}
+
+// SketchStore is implemented by stores that persist distinct count sketches.
+// Sketches are kept separately from events, so they outlive deleted events
+// and dropped partitions.
+type SketchStore interface {
+	// MergeSketches merges the sketches into the stored ones of the same key, field and start
+	MergeSketches(sketches []Sketch) error
+	// QuerySketches returns the sketches of the field in the query's key and time range
+	QuerySketches(q Query, field string) ([]Sketch, error)
+}
+
+type sketchID struct {
+	key   string
+	field string
+	start int64
+}
+
+// buildSketches returns the sketches of the configured fields of the events,
+// fields maps event keys to the data fields to count
+func buildSketches(events []Event, fields map[string][]string) []Sketch {
+	seconds := int64(SketchInterval / time.Second)
+	sketches := make(map[sketchID]*HyperLogLog)
+
+	for _, e := range events {
+		for _, field := range fields[e.Key] {
+			v, ok := e.Data[field]
+			if !ok || v == nil {
+				continue
+			}
+
+			id := sketchID{key: e.Key, field: field, start: e.Timestamp.Unix() / seconds * seconds}
+			hll, ok := sketches[id]
+			if !ok {
+				hll = NewHyperLogLog()
+				sketches[id] = hll
+			}
+			hll.Add(fmt.Sprint(v))
+		}
+	}
+
+	result := make([]Sketch, 0, len(sketches))
+	for id, hll := range sketches {
+		result = append(result, Sketch{
+			Key:   id.key,
+			Field: id.field,
+			Start: time.Unix(id.start, 0).UTC(),
+			HLL:   hll,
+		})
+	}
+
+	// A stable order keeps concurrent merges from deadlocking in SQL stores
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if a.Field != b.Field {
+			return a.Field < b.Field
+		}
+		return a.Start.Before(b.Start)
+	})
+
+	return result
+}
+
+// mergeSketchMap merges the sketches into the map, the map's sketches are copies
+func mergeSketchMap(into map[sketchID]*HyperLogLog, sketches []Sketch) {
+	for _, s := range sketches {
+		id := sketchID{key: s.Key, field: s.Field, start: s.Start.Unix()}
+		hll, ok := into[id]
+		if !ok {
+			hll = NewHyperLogLog()
+			into[id] = hll
+		}
+		hll.Merge(s.HLL)
+	}
+}
+
+// sketchAligned reports whether t is zero or the start of a SketchInterval
+func sketchAligned(t time.Time) bool {
+	return t.IsZero() || t.Equal(t.Truncate(SketchInterval))
+}
+
+// DistinctCounts holds the distinct counts of fields per time bucket and over the whole range
+type DistinctCounts struct {
+	// Buckets maps keys and bucket starts to the counts per field
+	Buckets map[string]map[time.Time]map[string]uint64
+	// Totals maps keys to the counts per field over the whole range
+	Totals map[string]map[string]uint64
+}
+
+// CountDistinct merges the stored sketches of the fields into buckets of
+// interval, which must be a multiple of SketchInterval. The query's From and
+// To must fall on SketchInterval boundaries, as sketches cannot be split.
+// Sketches hold every event, so ExcludeBots and Field are rejected.
+func CountDistinct(store SketchStore, q Query, interval time.Duration, fields []string) (DistinctCounts, error) {
+	if interval < SketchInterval || interval%SketchInterval != 0 {
+		return DistinctCounts{}, fmt.Errorf("distinct count interval must be a multiple of %s, got %s", SketchInterval, interval)
+	}
+	if !sketchAligned(q.From) || !sketchAligned(q.To) {
+		return DistinctCounts{}, fmt.Errorf("distinct count range must start and end on a multiple of %s", SketchInterval)
+	}
+	if q.ExcludeBots || q.Field != "" {
+		return DistinctCounts{}, fmt.Errorf("distinct counts cannot exclude bots or filter by field")
+	}
+
+	seconds := int64(interval / time.Second)
+	buckets := make(map[sketchID]*HyperLogLog)
+	totals := make(map[sketchID]*HyperLogLog)
+
+	for _, field := range fields {
+		sketches, err := store.QuerySketches(q, field)
+		if err != nil {
+			return DistinctCounts{}, fmt.Errorf("failed to query sketches: %w", err)
+		}
+
+		for _, s := range sketches {
+			bucket := s
+			bucket.Start = time.Unix(s.Start.Unix()/seconds*seconds, 0)
+			mergeSketchMap(buckets, []Sketch{bucket})
+
+			total := s
+			total.Start = time.Unix(0, 0)
+			mergeSketchMap(totals, []Sketch{total})
+		}
+	}
+
+	counts := DistinctCounts{
+		Buckets: make(map[string]map[time.Time]map[string]uint64),
+		Totals:  make(map[string]map[string]uint64),
+	}
+	for id, hll := range buckets {
+		start := time.Unix(id.start, 0).UTC()
+		if counts.Buckets[id.key] == nil {
+			counts.Buckets[id.key] = make(map[time.Time]map[string]uint64)
+		}
+		if counts.Buckets[id.key][start] == nil {
+			counts.Buckets[id.key][start] = make(map[string]uint64)
+		}
+		counts.Buckets[id.key][start][id.field] = hll.Count()
+	}
+	for id, hll := range totals {
+		if counts.Totals[id.key] == nil {
+			counts.Totals[id.key] = make(map[string]uint64)
+		}
+		counts.Totals[id.key][id.field] = hll.Count()
+	}
+
+	return counts, nil
+}
+
+// addDistinct adds the distinct counts to the buckets. Buckets only known from
+// sketches, e.g. of deleted events, are added with a count of 0.
+func addDistinct(buckets []AggregateBucket, counts DistinctCounts) []AggregateBucket {
+	seen := make(map[string]map[time.Time]bool)
+	for i, bucket := range buckets {
+		start := bucket.Start.UTC()
+		if seen[bucket.Key] == nil {
+			seen[bucket.Key] = make(map[time.Time]bool)
+		}
+		seen[bucket.Key][start] = true
+		buckets[i].Distinct = counts.Buckets[bucket.Key][start]
+	}
+
+	for key, starts := range counts.Buckets {
+		for start, distinct := range starts {
+			if !seen[key][start] {
+				buckets = append(buckets, AggregateBucket{Key: key, Start: start, Distinct: distinct})
+			}
+		}
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		if !buckets[i].Start.Equal(buckets[j].Start) {
+			return buckets[i].Start.Before(buckets[j].Start)
+		}
+		return buckets[i].Key < buckets[j].Key
+	})
+
+	return buckets
+}
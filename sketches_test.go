@@ -0,0 +1,183 @@
+package tlytics
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	a, b := NewHyperLogLog(), NewHyperLogLog()
+	for i := 0; i < 60000; i++ {
+		a.Add(fmt.Sprintf("user-%d", i))
+	}
+	for i := 40000; i < 100000; i++ {
+		b.Add(fmt.Sprintf("user-%d", i))
+	}
+
+	if count := a.Count(); math.Abs(float64(count)-60000)/60000 > 0.05 {
+		t.Errorf("Expected about 60000, got %d", count)
+	}
+
+	// Values in both sketches are counted once
+	a.Merge(b)
+	if count := a.Count(); math.Abs(float64(count)-100000)/100000 > 0.05 {
+		t.Errorf("Expected about 100000 after merging, got %d", count)
+	}
+
+	small := NewHyperLogLog()
+	for i := 0; i < 3; i++ {
+		small.Add("same")
+		small.Add(fmt.Sprint(i))
+	}
+	if count := small.Count(); count != 4 {
+		t.Errorf("Expected 4, got %d", count)
+	}
+
+	for _, h := range []*HyperLogLog{a, small} {
+		data, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		decoded := NewHyperLogLog()
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Failed to unmarshal: %v", err)
+		}
+		if decoded.Count() != h.Count() {
+			t.Errorf("Expected %d after a round trip, got %d", h.Count(), decoded.Count())
+		}
+	}
+}
+
+func TestStoreSketches(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+	fields := map[string][]string{"view": {"user_id"}}
+
+	var events []Event
+	for i := 0; i < 30; i++ {
+		// 10 users per hour over 3 hours, users 0-4 come back every hour
+		user := i % 10
+		if user >= 5 {
+			user += i / 10 * 10
+		}
+		events = append(events, Event{
+			Key:       "view",
+			Timestamp: base.Add(time.Duration(i/10) * time.Hour),
+			Data:      map[string]interface{}{"user_id": user},
+		})
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			sketchStore := store.(SketchStore)
+
+			// Merging in two batches gives the same result as one
+			if err := sketchStore.MergeSketches(buildSketches(events[:15], fields)); err != nil {
+				t.Fatalf("Failed to merge sketches: %v", err)
+			}
+			if err := sketchStore.MergeSketches(buildSketches(events[15:], fields)); err != nil {
+				t.Fatalf("Failed to merge sketches: %v", err)
+			}
+
+			counts, err := CountDistinct(sketchStore, Query{Key: "view"}, time.Hour, []string{"user_id"})
+			if err != nil {
+				t.Fatalf("Failed to count distinct: %v", err)
+			}
+			for h := 0; h < 3; h++ {
+				if n := counts.Buckets["view"][base.Add(time.Duration(h)*time.Hour)]["user_id"]; n != 10 {
+					t.Errorf("Expected 10 users in hour %d, got %d", h, n)
+				}
+			}
+			if n := counts.Totals["view"]["user_id"]; n != 20 {
+				t.Errorf("Expected 20 users in total, got %d", n)
+			}
+
+			if _, err := CountDistinct(sketchStore, Query{}, 30*time.Minute, []string{"user_id"}); err == nil {
+				t.Error("Expected an error for an interval shorter than an hour")
+			}
+		})
+	}
+}
+
+func TestStatsDistinct(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+	store := NewMemoryStore()
+	logger := NewLogger(store, time.Hour)
+	logger.distinct = map[string][]string{"view": {"user_id"}}
+	defer logger.Stop()
+
+	for i := 0; i < 6; i++ {
+		logger.Emit(Event{
+			Key:       "view",
+			Timestamp: base.Add(time.Duration(i) * 20 * time.Minute),
+			Data:      map[string]interface{}{"user_id": fmt.Sprint("u", i%3)},
+		})
+	}
+	logger.Flush()
+
+	// Sketches outlive deleted events
+	store.DeleteEvents(Query{To: base.Add(time.Hour)})
+
+	gin.SetMode(gin.TestMode)
+	server := newHTTPServer(logger, store, 0)
+
+	req := httptest.NewRequest("GET", "/stats?key=view&interval=1h&distinct=user_id", nil)
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response StatsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if len(response.Buckets) != 2 {
+		t.Fatalf("Expected 2 buckets, got %v", response.Buckets)
+	}
+	first, second := response.Buckets[0], response.Buckets[1]
+	if first.Count != 0 || first.Distinct["user_id"] != 3 {
+		t.Errorf("Expected the deleted hour to keep 3 distinct users, got %+v", first)
+	}
+	if second.Count != 3 || second.Distinct["user_id"] != 3 {
+		t.Errorf("Expected 3 events of 3 users, got %+v", second)
+	}
+	if response.DistinctTotals["view"]["user_id"] != 3 {
+		t.Errorf("Expected 3 distinct users in total, got %v", response.DistinctTotals)
+	}
+
+	req = httptest.NewRequest("GET", "/stats?interval=15m&distinct=user_id", nil)
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a 15m interval, got %d", w.Code)
+	}
+
+	// Hourly sketches would count values outside a range not on the hour
+	req = httptest.NewRequest("GET", "/stats?interval=1h&distinct=user_id&from=2025-08-25T10:30:00Z", nil)
+	w = httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for from not on the hour, got %d", w.Code)
+	}
+	// Sketches hold every event of the hour, filters would not apply to them
+	for _, filter := range []string{"exclude_bots=true", "filter_field=path&filter_value=/"} {
+		req = httptest.NewRequest("GET", "/stats?interval=1h&distinct=user_id&"+filter, nil)
+		w = httptest.NewRecorder()
+		server.router().ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for distinct counts with %s, got %d", filter, w.Code)
+		}
+	}
+	if _, err := CountDistinct(store, Query{To: time.Date(2025, 8, 25, 11, 0, 1, 0, time.UTC)}, time.Hour, []string{"user_id"}); err == nil {
+		t.Error("Expected an error for to not on the hour")
+	}
+}
@@ -0,0 +1,74 @@
+package tlytics
+
+import (
+	"fmt"
+	"time"
+)
+
+// Store is the storage backend used by the Logger and the HTTP server
+type Store interface {
+	InsertEvents(events []Event) error
+	GetEvents(limit, offset int) ([]Event, int, error)
+	QueryEvents(q Query) ([]Event, error)
+	CountEvents(q Query) (int, error)
+	Aggregate(q Query, interval time.Duration) ([]AggregateBucket, error)
+	Breakdown(q Query, b Breakdown) ([]BreakdownGroup, error)
+	DeleteEvents(q Query) (int64, error)
+	Close() error
+}
+
+// Query selects events from a Store. Zero values mean "no constraint".
+type Query struct {
+	Key    string    // Only events with this key
+	From   time.Time // Events at or after this time
+	To     time.Time // Events before this time
+	Field  string    // Only events whose data has this field equal to Value
+	Value  string    // Compared to the field's value as text, e.g. "123" matches 123
+	Limit  int
+	Offset int
+
+	ExcludeBots bool // Skip events flagged with is_bot by ParseUserAgent
+}
+
+// AggregateBucket holds the number of events of one key in a time bucket
+type AggregateBucket struct {
+	Key      string            `json:"key"`
+	Start    time.Time         `json:"start"`
+	Count    int               `json:"count"`
+	Distinct map[string]uint64 `json:"distinct,omitempty"` // Distinct values per field, see CountDistinct
+}
+
+// matches reports whether the event satisfies the query filters
+func (q Query) matches(e Event) bool {
+	if q.Key != "" && e.Key != q.Key {
+		return false
+	}
+	if !q.From.IsZero() && e.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.Timestamp.Before(q.To) {
+		return false
+	}
+	if q.ExcludeBots && e.Data["is_bot"] == true {
+		return false
+	}
+	if q.Field != "" {
+		v, ok := e.Data[q.Field]
+		if !ok || v == nil || fmt.Sprint(v) != q.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// jsonPath returns the SQLite JSON path of a top level data field
+func jsonPath(field string) string {
+	return fmt.Sprintf("$.%q", field)
+}
+
+// jsonText returns the SQLite expression of a data field as text, formatted
+// like Query.matches does. path is a JSON path literal or placeholder, used
+// twice. JSON booleans would otherwise become 1 and 0.
+func jsonText(path string) string {
+	return fmt.Sprintf("CASE json_type(data, %s) WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' ELSE CAST(json_extract(data, %s) AS TEXT) END", path, path)
+}
@@ -0,0 +1,145 @@
+package tlytics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// subjectBatchSize is how many events are exported or deleted at a time
+const subjectBatchSize = 1000
+
+// ErasureRecord describes an erasure of a data subject's events
+type ErasureRecord struct {
+	Field      string    `json:"field"`
+	ValueHash  string    `json:"value_hash"` // HMAC-SHA256 of field and identifier, the identifier itself is not kept
+	Deleted    int64     `json:"deleted"`
+	Batches    int       `json:"batches"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// ErasureStore is implemented by stores that keep erasure records. Records are
+// kept apart from events, so retention and later erasures do not remove them.
+type ErasureStore interface {
+	// InsertErasure stores the record of an erasure
+	InsertErasure(record ErasureRecord) error
+	// Erasures returns the stored erasure records, newest first
+	Erasures() ([]ErasureRecord, error)
+}
+
+// ErasureHash returns the hex HMAC-SHA256 of the field and identifier keyed
+// with the secret, as recorded in ErasureRecord.ValueHash
+func ErasureHash(secret []byte, field, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(field + "\x00" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func subjectQuery(field, value string) Query {
+	return Query{Field: field, Value: value}
+}
+
+// FindSubject returns the number of events whose data field equals the
+// identifier. Fields hashed by HashFields hold the keyed hash, not the raw
+// identifier, so they cannot be found this way.
+func FindSubject(store Store, field, value string) (int, error) {
+	return store.CountEvents(subjectQuery(field, value))
+}
+
+// ExportSubject returns all events whose data field equals the identifier,
+// newest first. It pages by timestamp rather than offset, so events sharing a
+// timestamp or inserted during the export are neither skipped nor duplicated.
+// Like FindSubject it cannot find fields hashed by HashFields.
+func ExportSubject(store Store, field, value string) ([]Event, error) {
+	events := make([]Event, 0)
+	var to time.Time
+	for {
+		q := subjectQuery(field, value)
+		q.To = to
+		q.Limit = subjectBatchSize
+
+		batch, err := store.QueryEvents(q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export events: %w", err)
+		}
+		if len(batch) < subjectBatchSize {
+			return append(events, batch...), nil
+		}
+
+		// The batch may end within events sharing the last timestamp, so
+		// those are replaced by all events at that timestamp
+		last := batch[len(batch)-1].Timestamp
+		n := len(batch)
+		for n > 0 && batch[n-1].Timestamp.Equal(last) {
+			n--
+		}
+		events = append(events, batch[:n]...)
+
+		ties := subjectQuery(field, value)
+		ties.From = last
+		ties.To = last.Add(time.Microsecond)
+		tied, err := store.QueryEvents(ties)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export events: %w", err)
+		}
+		for _, e := range tied {
+			if e.Timestamp.Equal(last) {
+				events = append(events, e)
+			}
+		}
+
+		to = last
+	}
+}
+
+// EraseSubject deletes all events whose data field equals the identifier in
+// batches, so the writer is not blocked for long, and stores an ErasureRecord
+// with the identifier hashed by ErasureHash. The record is also stored if a
+// batch fails. The secret keeps the hash from being reversed by hashing
+// guessed identifiers.
+func EraseSubject(store Store, secret []byte, field, value string) (ErasureRecord, error) {
+	if len(secret) == 0 {
+		return ErasureRecord{}, fmt.Errorf("an erasure secret is required")
+	}
+	erasures, ok := store.(ErasureStore)
+	if !ok {
+		return ErasureRecord{}, fmt.Errorf("storage backend does not support erasure records")
+	}
+
+	record := ErasureRecord{
+		Field:     field,
+		ValueHash: ErasureHash(secret, field, value),
+		StartedAt: time.Now().UTC(),
+	}
+
+	q := subjectQuery(field, value)
+	q.Limit = subjectBatchSize
+
+	var eraseErr error
+	for {
+		n, err := store.DeleteEvents(q)
+		if err != nil {
+			eraseErr = fmt.Errorf("failed to delete events: %w", err)
+			record.Error = err.Error()
+			break
+		}
+
+		record.Deleted += n
+		record.Batches++
+		if n < subjectBatchSize {
+			break
+		}
+	}
+
+	record.FinishedAt = time.Now().UTC()
+
+	if err := erasures.InsertErasure(record); err != nil && eraseErr == nil {
+		eraseErr = fmt.Errorf("failed to store erasure record: %w", err)
+	}
+
+	return record, eraseErr
+}
@@ -0,0 +1,270 @@
+package tlytics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSubjectExportAndErasure(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+
+	// More events than one batch, across partitions, with the identifier as number and string
+	var events []Event
+	for i := 0; i < 2500; i++ {
+		var userID interface{} = 123
+		if i%2 == 0 {
+			userID = "123"
+		}
+		events = append(events, Event{
+			Key:       "view",
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+			Data:      map[string]interface{}{"user_id": userID},
+		})
+	}
+	events = append(events,
+		Event{Key: "view", Timestamp: base, Data: map[string]interface{}{"user_id": "1234"}},
+		Event{Key: "view", Timestamp: base, Data: map[string]interface{}{"account_id": "123"}},
+	)
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.InsertEvents(events); err != nil {
+				t.Fatalf("Failed to insert events: %v", err)
+			}
+
+			count, err := FindSubject(store, "user_id", "123")
+			if err != nil {
+				t.Fatalf("Failed to find subject: %v", err)
+			}
+			if count != 2500 {
+				t.Errorf("Expected 2500 events of the subject, got %d", count)
+			}
+
+			exported, err := ExportSubject(store, "user_id", "123")
+			if err != nil {
+				t.Fatalf("Failed to export subject: %v", err)
+			}
+			if len(exported) != 2500 {
+				t.Errorf("Expected 2500 exported events, got %d", len(exported))
+			}
+
+			secret := []byte("secret")
+			record, err := EraseSubject(store, secret, "user_id", "123")
+			if err != nil {
+				t.Fatalf("Failed to erase subject: %v", err)
+			}
+			if record.Deleted != 2500 || record.Batches != 3 {
+				t.Errorf("Expected 2500 events deleted in 3 batches, got %+v", record)
+			}
+
+			if count, _ := FindSubject(store, "user_id", "123"); count != 0 {
+				t.Errorf("Expected no events of the subject left, got %d", count)
+			}
+			if count, _ := store.CountEvents(Query{}); count != 2 {
+				t.Errorf("Expected the other events to be kept and no audit events, got %d", count)
+			}
+
+			// Retention does not remove the records
+			if _, err := store.DeleteEvents(Query{}); err != nil {
+				t.Fatalf("Failed to delete events: %v", err)
+			}
+
+			erasures, err := store.(ErasureStore).Erasures()
+			if err != nil {
+				t.Fatalf("Failed to retrieve erasures: %v", err)
+			}
+			if len(erasures) != 1 {
+				t.Fatalf("Expected 1 erasure record, got %d", len(erasures))
+			}
+			if erasures[0].Field != "user_id" || erasures[0].ValueHash != record.ValueHash || erasures[0].Deleted != 2500 {
+				t.Errorf("Expected the record to describe the erasure, got %+v", erasures[0])
+			}
+			if erasures[0].FinishedAt.Sub(record.FinishedAt).Abs() > time.Millisecond {
+				t.Errorf("Expected finished at %v, got %v", record.FinishedAt, erasures[0].FinishedAt)
+			}
+
+			if record.ValueHash != ErasureHash(secret, "user_id", "123") || record.ValueHash == ErasureHash([]byte("other"), "user_id", "123") {
+				t.Error("Expected the identifier hash to be keyed with the secret")
+			}
+			if sum := sha256.Sum256([]byte("123")); record.ValueHash == hex.EncodeToString(sum[:]) {
+				t.Error("Expected the identifier hash not to be a plain SHA-256")
+			}
+		})
+	}
+}
+
+func TestExportSubjectPaging(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+
+	// Groups of 700 events share a timestamp, so every batch ends inside a group
+	var events []Event
+	for i := 0; i < 2100; i++ {
+		events = append(events, Event{
+			Key:       "view",
+			Timestamp: base.Add(time.Duration(i/700) * time.Minute),
+			Data:      map[string]interface{}{"user_id": "123", "n": i},
+		})
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.InsertEvents(events); err != nil {
+				t.Fatalf("Failed to insert events: %v", err)
+			}
+
+			// An event of the subject arrives after the first batch
+			exported, err := ExportSubject(&insertingStore{Store: store, t: t}, "user_id", "123")
+			if err != nil {
+				t.Fatalf("Failed to export subject: %v", err)
+			}
+			if len(exported) != 2100 {
+				t.Fatalf("Expected 2100 exported events, got %d", len(exported))
+			}
+
+			seen := make(map[string]bool)
+			for i, e := range exported {
+				n := fmt.Sprint(e.Data["n"])
+				if seen[n] {
+					t.Fatalf("Expected each event once, got %s twice", n)
+				}
+				seen[n] = true
+				if i > 0 && e.Timestamp.After(exported[i-1].Timestamp) {
+					t.Fatalf("Expected events newest first, got %v after %v", e.Timestamp, exported[i-1].Timestamp)
+				}
+			}
+		})
+	}
+}
+
+// insertingStore inserts a new event of the subject after the first query
+type insertingStore struct {
+	Store
+	t        *testing.T
+	inserted bool
+}
+
+func (s *insertingStore) QueryEvents(q Query) ([]Event, error) {
+	events, err := s.Store.QueryEvents(q)
+	if !s.inserted {
+		s.inserted = true
+		e := Event{Key: "view", Timestamp: time.Now().UTC(), Data: map[string]interface{}{"user_id": "123", "n": -1}}
+		if err := s.Store.InsertEvents([]Event{e}); err != nil {
+			s.t.Fatalf("Failed to insert event: %v", err)
+		}
+	}
+	return events, err
+}
+
+func TestEraseSubjectRequiresSecret(t *testing.T) {
+	store := NewMemoryStore()
+	store.InsertEvents([]Event{{Key: "view", Timestamp: time.Now(), Data: map[string]interface{}{"user_id": "123"}}})
+
+	if _, err := EraseSubject(store, nil, "user_id", "123"); err == nil {
+		t.Error("Expected an error without a secret")
+	}
+	if count, _ := store.CountEvents(Query{}); count != 1 {
+		t.Errorf("Expected the events to be kept, got %d", count)
+	}
+}
+
+func TestSubjectEndpointsRequireAdminToken(t *testing.T) {
+	store := NewMemoryStore()
+	store.InsertEvents([]Event{{Key: "view", Timestamp: time.Now(), Data: map[string]interface{}{"user_id": "123"}}})
+
+	logger := NewLogger(store, time.Hour)
+	defer logger.Stop()
+
+	gin.SetMode(gin.TestMode)
+	server := newHTTPServer(logger, store, 0)
+
+	requests := [][2]string{
+		{"GET", "/admin/subjects?field=user_id&value=123"},
+		{"GET", "/admin/subjects/export?field=user_id&value=123"},
+		{"DELETE", "/admin/subjects?field=user_id&value=123"},
+		{"GET", "/admin/erasures"},
+		{"POST", "/admin/backup"},
+	}
+
+	// No admin token configured, the endpoints are disabled
+	for _, r := range requests {
+		w := httptest.NewRecorder()
+		server.router().ServeHTTP(w, httptest.NewRequest(r[0], r[1], nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status 403 for %s %s without an admin token, got %d", r[0], r[1], w.Code)
+		}
+	}
+	if count, _ := store.CountEvents(Query{}); count != 1 {
+		t.Errorf("Expected the subject's events to be kept, got %d", count)
+	}
+
+	server.adminToken = "secret"
+	for _, token := range []string{"", "wrong"} {
+		req := httptest.NewRequest("GET", "/admin/subjects/export?field=user_id&value=123", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		server.router().ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 for token %q, got %d", token, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/admin/subjects?field=user_id&value=123", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 with the admin token, got %d", w.Code)
+	}
+}
+
+func TestEraseSubjectEndpoint(t *testing.T) {
+	store := NewMemoryStore()
+	store.InsertEvents([]Event{{Key: "view", Timestamp: time.Now(), Data: map[string]interface{}{"user_id": "123"}}})
+
+	logger := NewLogger(store, time.Hour)
+	defer logger.Stop()
+
+	gin.SetMode(gin.TestMode)
+	server := newHTTPServer(logger, store, 0)
+	server.adminToken = "token"
+
+	erase := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", "/admin/subjects?field=user_id&value=123", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		server.router().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := erase(); w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status 501 without an erasure secret, got %d", w.Code)
+	}
+
+	server.erasureSecret = []byte("secret")
+	if w := erase(); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req := httptest.NewRequest("GET", "/admin/erasures", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	server.router().ServeHTTP(w, req)
+
+	var response struct {
+		Erasures []ErasureRecord `json:"erasures"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(response.Erasures) != 1 || response.Erasures[0].Deleted != 1 {
+		t.Errorf("Expected 1 erasure record of 1 event, got %+v", response.Erasures)
+	}
+}
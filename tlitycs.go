@@ -1,7 +1,9 @@
 package tlytics
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -12,22 +14,61 @@ type Emitter interface {
 
 // Tlytics represents a server instance
 type Tlytics struct {
-	db     *DB
-	logger *Logger
-	server *Server
+	store   Store
+	logger  *Logger
+	server  *Server
+	backups *backupManager
+	secret  []byte
+	stopCh  chan struct{}
+	wg      sync.WaitGroup
 }
 
 // Config for client connecting to remote server
 type Config struct {
-	ServerURL   string        // Remote server URL (e.g., "http://192.168.1.100:8081")
-	FlushPeriod time.Duration // How often to flush queued events
+	ServerURL    string        // Remote server URL (e.g., "http://192.168.1.100:8081")
+	FlushPeriod  time.Duration // How often to flush queued events
+	Processors   []Processor   // Run in order on every event before it is queued
+	RawPIIFields []string      // Emit rejects events with these fields with ErrRawPII
 }
 
+// Storage backends selectable in ServerConfig
+const (
+	BackendSQLite      = "sqlite"
+	BackendMemory      = "memory"
+	BackendPostgres    = "postgres"
+	BackendPartitioned = "partitioned"
+)
+
 // ServerConfig for running local analytics server
 type ServerConfig struct {
-	DBPath      string
+	DBPath      string // SQLite file, or directory of partition files for BackendPartitioned
 	FlushPeriod time.Duration
 	ServerPort  int
+	Backend     string // Storage backend, BackendSQLite if empty
+	DatabaseURL string // PostgreSQL connection string for BackendPostgres
+	Store       Store  // Custom storage backend, overrides Backend
+
+	Partition          string        // PartitionDaily (default) or PartitionMonthly for BackendPartitioned
+	PartitionRetention time.Duration // Drop partitions older than this, 0 keeps everything
+
+	BackupDir      string        // Directory for backups, enables POST /admin/backup
+	BackupInterval time.Duration // How often to back up to BackupDir, 0 disables scheduled backups
+	BackupKeep     int           // Number of backups to keep, 0 keeps all
+	AdminToken     string        // Bearer token required by /admin endpoints, which are disabled if empty
+	ErasureSecret  string        // Key of the identifier hashes in erasure records, required to erase subjects
+
+	Processors   []Processor // Run in order on every event before it is stored, including ingested ones
+	RawPIIFields []string    // Events with these fields are rejected, ingest endpoints respond 400
+
+	ParseUserAgents bool // Add browser, OS, device and bot fields from user_agent before Processors run
+
+	GeoIPDatabases      []string      // MaxMind .mmdb files adding geo and ASN fields from client_ip before Processors run
+	GeoIPReloadInterval time.Duration // How often to check the GeoIP files for changes, 1m if 0
+
+	Sessions SessionConfig // Defaults for GET /sessions
+
+	DistinctFields map[string][]string // Data fields per event key to keep distinct count sketches of, e.g. {"http_request": {"user_id"}}
+	HotFields      map[string][]string // Data fields per event key to keep in indexed columns for fast filtering and grouping, e.g. {"http_request": {"path", "status_code"}}
 }
 
 // NewClient creates a client that connects to a remote analytics server
@@ -36,7 +77,7 @@ func NewClient(config Config) (*Client, error) {
 		return nil, fmt.Errorf("ServerURL is required")
 	}
 
-	client := newHTTPClient(config.ServerURL, config.FlushPeriod)
+	client := newHTTPClient(config.ServerURL, config.FlushPeriod, config.Processors, config.RawPIIFields)
 	
 	return client, nil
 }
@@ -51,19 +92,132 @@ func NewServer(config ServerConfig) (*Tlytics, error) {
 		config.ServerPort = 8080
 	}
 	
-	db, err := Init(config.DBPath)
+	var geoip *GeoIP
+	if len(config.GeoIPDatabases) > 0 {
+		var err error
+		geoip, err = NewGeoIP(config.GeoIPDatabases...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	store, err := openStore(config)
 	if err != nil {
 		return nil, err
 	}
 	
-	logger := NewLogger(db, config.FlushPeriod)
-	server := newHTTPServer(logger, config.ServerPort)
+	// A store passed in config belongs to the caller and is left open
+	closeStore := func() {
+		if config.Store == nil {
+			store.Close()
+		}
+	}
+	
+	if _, ok := store.(SketchStore); len(config.DistinctFields) > 0 && !ok {
+		closeStore()
+		return nil, fmt.Errorf("storage backend does not support distinct counts")
+	}
+	
+	if len(config.HotFields) > 0 {
+		hotStore, ok := store.(HotFieldStore)
+		if !ok {
+			closeStore()
+			return nil, fmt.Errorf("storage backend does not support hot fields")
+		}
+		if err := hotStore.SetHotFields(config.HotFields); err != nil {
+			closeStore()
+			return nil, err
+		}
+	}
+	
+	// Validate everything before the logger starts its flush goroutine
+	var backuper Backuper
+	if config.BackupDir != "" {
+		var ok bool
+		backuper, ok = store.(Backuper)
+		if !ok {
+			closeStore()
+			return nil, fmt.Errorf("storage backend does not support backups")
+		}
+	}
+	
+	if _, ok := store.(ErasureStore); config.ErasureSecret != "" && !ok {
+		closeStore()
+		return nil, fmt.Errorf("storage backend does not support erasure records")
+	}
+	
+	logger := NewLogger(store, config.FlushPeriod, serverProcessors(config, geoip)...)
+	logger.rawPII = config.RawPIIFields
+	logger.distinct = config.DistinctFields
+	server := newHTTPServer(logger, store, config.ServerPort)
+	server.adminToken = config.AdminToken
+	server.sessions = config.Sessions
+	server.erasureSecret = []byte(config.ErasureSecret)
 	
-	return &Tlytics{
-		db:     db,
+	t := &Tlytics{
+		store:  store,
 		logger: logger,
 		server: server,
-	}, nil
+		secret: []byte(config.ErasureSecret),
+		stopCh: make(chan struct{}),
+	}
+	
+	if backuper != nil {
+		t.backups = newBackupManager(backuper, config.BackupDir, config.BackupKeep)
+		server.backups = t.backups
+		
+		if config.BackupInterval > 0 {
+			t.wg.Add(1)
+			go t.backups.backupWorker(config.BackupInterval, t.stopCh, &t.wg)
+		}
+	}
+	
+	if geoip != nil {
+		interval := config.GeoIPReloadInterval
+		if interval == 0 {
+			interval = defaultGeoIPReloadInterval
+		}
+		t.wg.Add(1)
+		go geoip.reloadWorker(interval, t.stopCh, &t.wg)
+	}
+	
+	return t, nil
+}
+
+// serverProcessors returns the enrichment processors enabled in the config
+// followed by the configured processors
+func serverProcessors(config ServerConfig, geoip *GeoIP) []Processor {
+	var processors []Processor
+	if config.ParseUserAgents {
+		processors = append(processors, ParseUserAgent())
+	}
+	if geoip != nil {
+		processors = append(processors, geoip.Processor())
+	}
+	return append(processors, config.Processors...)
+}
+
+// openStore returns the storage backend selected in the config
+func openStore(config ServerConfig) (Store, error) {
+	if config.Store != nil {
+		return config.Store, nil
+	}
+	
+	switch config.Backend {
+	case "", BackendSQLite:
+		return Init(config.DBPath)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	case BackendPostgres:
+		if config.DatabaseURL == "" {
+			return nil, fmt.Errorf("DatabaseURL is required for the postgres backend")
+		}
+		return NewPostgresStore(config.DatabaseURL)
+	case BackendPartitioned:
+		return NewPartitionedStore(config.DBPath, config.Partition, config.PartitionRetention)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", config.Backend)
+	}
 }
 
 // New creates a client (for backwards compatibility, but NewClient is preferred)
@@ -76,11 +230,21 @@ func (t *Tlytics) Emit(event Event) error {
 	return t.logger.Emit(event)
 }
 
+// EmitContext sends an event with the properties attached to the context to the server logger
+func (t *Tlytics) EmitContext(ctx context.Context, event Event) error {
+	return t.logger.EmitContext(ctx, event)
+}
+
 // GetLogger returns the server logger
 func (t *Tlytics) GetLogger() *Logger {
 	return t.logger
 }
 
+// GetStore returns the server storage backend
+func (t *Tlytics) GetStore() Store {
+	return t.store
+}
+
 
 // StartServer starts the analytics server
 func (t *Tlytics) StartServer() error {
@@ -92,8 +256,28 @@ func (t *Tlytics) Flush() {
 	t.logger.Flush()
 }
 
+// Backup writes a backup to the configured BackupDir and returns its path
+func (t *Tlytics) Backup() (string, error) {
+	if t.backups == nil {
+		return "", fmt.Errorf("BackupDir is not configured")
+	}
+	return t.backups.run()
+}
+
+// EraseSubject flushes queued events and deletes all events whose data field
+// equals the identifier, see EraseSubject. ErasureSecret must be configured.
+func (t *Tlytics) EraseSubject(field, value string) (ErasureRecord, error) {
+	if len(t.secret) == 0 {
+		return ErasureRecord{}, fmt.Errorf("ErasureSecret is not configured")
+	}
+	t.logger.Flush()
+	return EraseSubject(t.store, t.secret, field, value)
+}
+
 // Close properly closes the server instance
 func (t *Tlytics) Close() error {
+	close(t.stopCh)
+	t.wg.Wait()
 	t.logger.Stop()
-	return t.db.Close()
+	return t.store.Close()
 }
\ No newline at end of file
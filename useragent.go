@@ -0,0 +1,105 @@
+package tlytics
+
+import (
+	_ "embed"
+	"strings"
+
+	"github.com/mssola/useragent"
+)
+
+//go:embed bots.txt
+var botList string
+
+// botPatterns are the lowercase user agent substrings of known bots
+var botPatterns = parseBotList(botList)
+
+func parseBotList(list string) []string {
+	var patterns []string
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.ToLower(line))
+	}
+	return patterns
+}
+
+// isBot reports whether the user agent matches the embedded bot list
+func isBot(ua string) bool {
+	ua = strings.ToLower(ua)
+	for _, pattern := range botPatterns {
+		if strings.Contains(ua, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Device types set by ParseUserAgent
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+)
+
+// osNames maps the parser's OS names to their current names
+var osNames = map[string]string{
+	"iPhone OS": "iOS",
+	"Mac OS X":  "macOS",
+}
+
+// userAgentFields parses the user agent into browser, OS, device and bot fields
+func userAgentFields(ua string) map[string]interface{} {
+	parsed := useragent.New(ua)
+	browser, browserVersion := parsed.Browser()
+	osInfo := parsed.OSInfo()
+	if name, ok := osNames[osInfo.Name]; ok {
+		osInfo.Name = name
+	}
+	if parsed.Platform() == "iPad" {
+		osInfo.Name = "iPadOS"
+	}
+	bot := parsed.Bot() || isBot(ua)
+
+	device := DeviceDesktop
+	switch {
+	case bot:
+		device = DeviceBot
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet") ||
+		strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile"):
+		device = DeviceTablet
+	case parsed.Mobile():
+		device = DeviceMobile
+	}
+
+	return map[string]interface{}{
+		"browser":         browser,
+		"browser_version": browserVersion,
+		"os":              osInfo.Name,
+		"os_version":      osInfo.Version,
+		"device_type":     device,
+		"is_bot":          bot,
+	}
+}
+
+// ParseUserAgent adds browser, browser_version, os, os_version, device_type
+// and is_bot fields to events with a user_agent field. Fields already in the
+// event are kept. ServerConfig.ParseUserAgents runs it on the server before
+// the other processors, so it still sees user agents they redact.
+func ParseUserAgent() Processor {
+	return func(e *Event) bool {
+		ua, ok := e.Data["user_agent"].(string)
+		if !ok || ua == "" {
+			return true
+		}
+
+		for k, v := range userAgentFields(ua) {
+			if _, ok := e.Data[k]; !ok {
+				e.Data[k] = v
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,94 @@
+package tlytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		ua      string
+		browser string
+		os      string
+		device  string
+		bot     bool
+	}{
+		{
+			ua:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+			browser: "Chrome",
+			os:      "Windows",
+			device:  DeviceDesktop,
+		},
+		{
+			ua:      "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			browser: "Safari",
+			os:      "iOS",
+			device:  DeviceMobile,
+		},
+		{
+			ua:      "Mozilla/5.0 (iPad; CPU OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			browser: "Safari",
+			os:      "iPadOS",
+			device:  DeviceTablet,
+		},
+		{
+			ua:     "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			device: DeviceBot,
+			bot:    true,
+		},
+		{
+			ua:     "curl/8.5.0",
+			device: DeviceBot,
+			bot:    true,
+		},
+	}
+
+	process := ParseUserAgent()
+	for _, tt := range tests {
+		e := Event{Key: "http_request", Data: map[string]interface{}{"user_agent": tt.ua}}
+		process(&e)
+
+		if e.Data["device_type"] != tt.device || e.Data["is_bot"] != tt.bot {
+			t.Errorf("%s: expected device %s and bot %v, got %v", tt.ua, tt.device, tt.bot, e.Data)
+		}
+		if tt.browser != "" && e.Data["browser"] != tt.browser {
+			t.Errorf("%s: expected browser %s, got %v", tt.ua, tt.browser, e.Data["browser"])
+		}
+		if tt.os != "" && e.Data["os"] != tt.os {
+			t.Errorf("%s: expected OS %s, got %v", tt.ua, tt.os, e.Data["os"])
+		}
+	}
+}
+
+func TestQueryExcludeBots(t *testing.T) {
+	base := time.Date(2025, 8, 25, 10, 0, 0, 0, time.UTC)
+	events := []Event{
+		{Key: "http_request", Timestamp: base, Data: map[string]interface{}{"is_bot": false}},
+		{Key: "http_request", Timestamp: base, Data: map[string]interface{}{"is_bot": true}},
+		{Key: "http_request", Timestamp: base, Data: map[string]interface{}{}},
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.InsertEvents(events); err != nil {
+				t.Fatalf("Failed to insert events: %v", err)
+			}
+
+			count, err := store.CountEvents(Query{ExcludeBots: true})
+			if err != nil {
+				t.Fatalf("Failed to count events: %v", err)
+			}
+			if count != 2 {
+				t.Errorf("Expected 2 events without bots, got %d", count)
+			}
+
+			buckets, err := store.Aggregate(Query{ExcludeBots: true}, time.Hour)
+			if err != nil {
+				t.Fatalf("Failed to aggregate events: %v", err)
+			}
+			if len(buckets) != 1 || buckets[0].Count != 2 {
+				t.Errorf("Expected 1 bucket of 2 events, got %v", buckets)
+			}
+		})
+	}
+}